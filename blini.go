@@ -0,0 +1,163 @@
+// Package blini provides lightweight nucleotide sequence searching and
+// clustering, using frac-min-hash sketches.
+//
+// This package is the library behind the blini command-line tool.
+package blini
+
+import (
+	"fmt"
+
+	"github.com/fluhus/biostuff/mash/v2"
+	"github.com/fluhus/blini/sketching"
+)
+
+const (
+	idxScale  = 4    // Index stores 1/idxScale of the sketch hashes.
+	useMyDist = true // Use a new experiemental distance func.
+
+	// SketchFileSuffix is the suffix of sketch files.
+	SketchFileSuffix = ".blini"
+)
+
+// Version is the blini version that is written in sketch files.
+var Version = "development version"
+
+// Sketch is a sketch of a single sequence or genome.
+type Sketch struct {
+	Name    string   // Sequence name.
+	Hashes  []uint64 // Frac min hash sketch, sorted.
+	Counts  []uint32 // Hash counts, nil if abundances are not tracked.
+	Length  int      // Sequence length.
+	Records []int    // Input record numbers, when sketched from a file.
+	Scale   uint64   // Kmer selection scale.
+	K       int      // Kmer length.
+}
+
+// Sketches holds sketches of input sequences and metadata.
+// The i'th sketch's data is in the i'th element of each slice.
+type Sketches struct {
+	Hashes  [][]uint64 // Frac min hash sketches.
+	Lengths []int      // Sequence lengths.
+	Names   []string   // Sequence names.
+	Records [][]int    // Input record numbers of each sketch.
+	Counts  [][]uint32 // Hash counts, nil if abundances are not tracked.
+	Scale   uint64     // Kmer selection scale.
+	K       int        // Kmer length.
+}
+
+// Len returns the number of sketches.
+func (sk *Sketches) Len() int {
+	return len(sk.Hashes)
+}
+
+// At returns the i'th sketch.
+func (sk *Sketches) At(i int) Sketch {
+	s := Sketch{
+		Name:   sk.Names[i],
+		Hashes: sk.Hashes[i],
+		Length: sk.Lengths[i],
+		Scale:  sk.Scale,
+		K:      sk.K,
+	}
+	if sk.Records != nil {
+		s.Records = sk.Records[i]
+	}
+	if sk.Counts != nil {
+		s.Counts = sk.Counts[i]
+	}
+	return s
+}
+
+// Add appends a sketch.
+// The first sketch added to empty sketches sets their scale and kmer
+// length (if not set) and whether they track abundances.
+// Returns an error if the sketch's scale, kmer length or abundance
+// tracking differ from those of the sketches.
+func (sk *Sketches) Add(s Sketch) error {
+	if sk.Len() == 0 {
+		if sk.Scale == 0 && sk.K == 0 {
+			sk.Scale, sk.K = s.Scale, s.K
+		}
+		if s.Counts != nil && sk.Counts == nil {
+			sk.Counts = [][]uint32{}
+		}
+	}
+	if s.Scale != sk.Scale {
+		return fmt.Errorf("mismatching scales: %d, %d", sk.Scale, s.Scale)
+	}
+	if s.K != sk.K {
+		return fmt.Errorf("mismatching kmer lengths: %d, %d", sk.K, s.K)
+	}
+	if (s.Counts != nil) != (sk.Counts != nil) {
+		return fmt.Errorf("mismatching abundance tracking")
+	}
+	sk.Hashes = append(sk.Hashes, s.Hashes)
+	sk.Lengths = append(sk.Lengths, s.Length)
+	sk.Names = append(sk.Names, s.Name)
+	sk.Records = append(sk.Records, s.Records)
+	if sk.Counts != nil {
+		sk.Counts = append(sk.Counts, s.Counts)
+	}
+	return nil
+}
+
+// Returns an error if abundance is requested and any of the sketches
+// have no counts.
+func (opts SimilarityOptions) check(sks ...*Sketches) error {
+	if !opts.Abundance {
+		return nil
+	}
+	for _, sk := range sks {
+		if sk.Counts == nil && sk.Len() > 0 {
+			return fmt.Errorf("abundance similarity requires hash counts")
+		}
+	}
+	return nil
+}
+
+// SimilarityOptions control similarity calculation.
+type SimilarityOptions struct {
+	// Use containment of the first sketch in the second,
+	// rather than full match.
+	Containment bool
+
+	// Use abundance-weighted similarity. Requires hash counts.
+	Abundance bool
+}
+
+// Similarity returns the similarity between sketches a and b,
+// between 0 and 1.
+// Returns an error if the sketches are incompatible, or if abundance is
+// requested and they have no counts.
+func Similarity(a, b Sketch, opts SimilarityOptions) (float64, error) {
+	if a.K != b.K || a.Scale != b.Scale {
+		return 0, fmt.Errorf("mismatching k or scale: k=%d scale=%d, "+
+			"k=%d scale=%d", a.K, a.Scale, b.K, b.Scale)
+	}
+	if opts.Abundance && (len(a.Counts) != len(a.Hashes) ||
+		len(b.Counts) != len(b.Hashes)) {
+		return 0, fmt.Errorf("abundance similarity requires hash counts")
+	}
+	return similarity(a, b, opts), nil
+}
+
+// Returns the similarity between sketches a and b, without checking
+// that they are compatible.
+func similarity(a, b Sketch, opts SimilarityOptions) float64 {
+	k := a.K
+	switch {
+	case opts.Abundance && opts.Containment:
+		return 1 - mash.FromJaccard(sketching.WeightedContainment(
+			a.Hashes, a.Counts, b.Hashes, b.Counts), k)
+	case opts.Abundance:
+		return 1 - mash.FromJaccard(sketching.WeightedJaccard(
+			a.Hashes, a.Counts, b.Hashes, b.Counts), k)
+	case opts.Containment:
+		return 1 - mash.FromJaccard(
+			sketching.Containment(a.Hashes, b.Hashes), k)
+	case useMyDist:
+		return 1 - sketching.MyDist(a.Hashes, b.Hashes, a.Length, b.Length, k)
+	default:
+		return 1 - mash.FromJaccard(sketching.Jaccard(a.Hashes, b.Hashes), k)
+	}
+}
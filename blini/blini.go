@@ -3,79 +3,551 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
+	"iter"
+	"math"
 	"os"
+	"regexp"
 	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
 
-	"github.com/fluhus/biostuff/mash/v2"
-	"github.com/fluhus/blini/sketching"
+	"github.com/fluhus/blini"
+	"github.com/fluhus/gostuff/aio"
+	"github.com/fluhus/gostuff/ptimer"
 )
 
 /*
 TODO
 - Make ptimer output to stdout
 - Tests for sketching and for common
-- Grouping by file, by regex?
 */
 
-const (
-	kmerLen  = 21
-	idxScale = 4
-
-	useMyDist    = true          // Use a new experiemental distance func.
-	indexSuffix  = ".blini"      // Suffix of pre-sketched files.
-	unmatchedRef = "(unmatched)" // The "reference" value of an unmatched query.
-)
+// The "reference" value of an unmatched query.
+const unmatchedRef = "(unmatched)"
 
+// Flag values. Each command defines the flags it uses on its own flag set.
 var (
-	qFile     = flag.String("q", "", "Query file")
-	rFile     = flag.String("r", "", "Reference file")
-	oFile     = flag.String("o", "", "Output file or prefix")
-	contn     = flag.Bool("c", false, "Use containment rather than full match")
-	minSim    = flag.Float64("m", 0.9, "Minimum similarity for match")
-	scale     = flag.Uint64("s", 100, "Use 1/`scale` of the kmers")
-	unmatched = flag.Bool("u", false, "Include unmatched queries in search output")
-
-	version = "development version"
+	qFile  = new(string)
+	rFile  = new(string)
+	inFile = new(string)
+	oFile  = new(string)
+
+	// Sketching.
+	scale      = new(uint64)
+	kmerLen    = new(int)
+	nThreads   = new(int)
+	abundance  = new(bool)
+	minAbund   = new(int)
+	minQual    = new(int)
+	groupRegex = new(*regexp.Regexp)
+	groupFile  = new(bool)
+	groupMap   = new(string)
+
+	// Similarity and searching.
+	contn     = new(bool)
+	minSim    = new(float64)
+	unmatched = new(bool)
+	topN      = new(int)
+	best      = new(bool)
+	columns   = new(string)
+	outFormat = new(string)
+	gatherMin = new(int)
+
+	// Index files.
+	writeIdx    = new(bool)
+	writeMapped = new(bool)
+
+	// Clustering.
+	clusterFormat = new(string)
+	prevClusters  = new(string)
+	reassign      = new(bool)
+	clusterMode   = new(string)
+	levels        = new(string)
+	repSelection  = new(string)
+	priorityFile  = new(string)
+
+	// Distances and trees.
+	distFormat = new(string)
+	treeMethod = new(string)
 )
 
+// A blini command.
+type command struct {
+	name     string                    // Name on the command line.
+	desc     string                    // One-line description.
+	args     string                    // Positional arguments, if any.
+	required []string                  // Names of required flags.
+	flags    func(fs *flag.FlagSet)    // Defines the command's flags.
+	run      func(args []string) error // Runs the command.
+}
+
+// All available commands.
+var commands = []command{
+	{
+		name:     "sketch",
+		desc:     "Pre-sketch sequences for quicker searches",
+		required: []string{"i"},
+		flags: func(fs *flag.FlagSet) {
+			addInputFlag(fs, false)
+			fs.StringVar(oFile, "o", "", "Output sketch `file`")
+			fs.BoolVar(writeIdx, "x", false,
+				"Also write an index file, for quicker searches")
+			fs.BoolVar(writeMapped, "xm", false,
+				"Also write a memory-mapped index file, "+
+					"for references that do not fit in memory")
+			addAbundanceFlag(fs)
+			addSketchFlags(fs)
+		},
+		run: noArgs(mainSketch),
+	},
+	{
+		name:     "search",
+		desc:     "Look up query sequences in a reference",
+		required: []string{"q", "r"},
+		flags: func(fs *flag.FlagSet) {
+			addSearchInputFlags(fs)
+			fs.StringVar(oFile, "o", "", "Output `file`")
+			fs.BoolVar(unmatched, "u", false,
+				"Include unmatched queries in the output")
+			intBetweenVar(fs, topN, "top", 0,
+				"Report only the `N` most similar references of each query",
+				0, math.MaxInt)
+			fs.BoolVar(best, "best", false,
+				"Report only the most similar reference of each query")
+			fs.StringVar(columns, "columns", "similarity,query,reference",
+				"Comma-separated output `columns`, out of: "+columnNames())
+			oneOfVar(fs, outFormat, "format", formatCSV,
+				"Output `format`: csv, tsv or jsonl",
+				formatCSV, formatTSV, formatJSONL)
+			addSimFlags(fs)
+			addAbundanceFlag(fs)
+			addSketchFlags(fs)
+		},
+		run: noArgs(mainSearch),
+	},
+	{
+		name:     "gather",
+		desc:     "Find the references that compose each query",
+		required: []string{"q", "r"},
+		flags: func(fs *flag.FlagSet) {
+			addSearchInputFlags(fs)
+			fs.StringVar(oFile, "o", "", "Output CSV `file`")
+			intBetweenVar(fs, gatherMin, "mh", 3,
+				"Minimal number of `hashes` a reference must explain",
+				1, math.MaxInt)
+			addSketchFlags(fs)
+		},
+		run: noArgs(mainGather),
+	},
+	{
+		name:     "cluster",
+		desc:     "Cluster (dereplicate) sequences",
+		required: []string{"i"},
+		flags: func(fs *flag.FlagSet) {
+			addInputFlag(fs, false)
+			fs.StringVar(oFile, "o", "", "Output files `prefix`")
+			oneOfVar(fs, clusterFormat, "format", formatJSON,
+				"Cluster assignments `format`: json, tsv or clstr",
+				formatJSON, formatTSV, formatClstr)
+			fs.StringVar(prevClusters, "prev", "", "Output files `prefix` "+
+				"of a previous run, to add the input to its clusters")
+			oneOfVar(fs, clusterMode, "cluster-mode", modeGreedy,
+				"Clustering `mode`: greedy, single or components "+
+					"(same as single)",
+				modeGreedy, modeSingle, modeComponents)
+			oneOfVar(fs, repSelection, "rep", repLongest,
+				"Representative `selection`: longest, shortest, input-order, "+
+					"centroid or priority-file",
+				repLongest, repShortest, repInputOrder, repCentroid,
+				repPriority)
+			fs.StringVar(priorityFile, "priority", "", "Names `file` in "+
+				"order of preference as representatives, for -rep "+
+				"priority-file")
+			fs.StringVar(levels, "levels", "", "Comma-separated minimum "+
+				"`similarities` for nested clustering at multiple levels")
+			fs.BoolVar(reassign, "reassign", false, "Move each member to "+
+				"the cluster of its most similar representative")
+			addSimFlags(fs)
+			addAbundanceFlag(fs)
+			addSketchFlags(fs)
+		},
+		run: noArgs(mainCluster),
+	},
+	{
+		name:     "dist",
+		desc:     "Calculate distances between all pairs of sequences",
+		required: []string{"i"},
+		flags: func(fs *flag.FlagSet) {
+			addInputFlag(fs, true)
+			fs.StringVar(oFile, "o", "", "Output `file`")
+			oneOfVar(fs, distFormat, "format", distPhylip,
+				"Output `format`: phylip, tsv or edges",
+				distPhylip, distTSV, distEdges)
+			addSimFlags(fs)
+			addAbundanceFlag(fs)
+			addSketchFlags(fs)
+		},
+		run: noArgs(mainDist),
+	},
+	{
+		name:     "tree",
+		desc:     "Build a tree of sequences",
+		required: []string{"i"},
+		flags: func(fs *flag.FlagSet) {
+			addInputFlag(fs, true)
+			fs.StringVar(oFile, "o", "", "Output Newick `file`")
+			oneOfVar(fs, treeMethod, "method", treeNJ,
+				"Tree building `method`: nj or upgma", treeNJ, treeUPGMA)
+			fs.BoolVar(contn, "c", false,
+				"Use containment rather than full match")
+			addAbundanceFlag(fs)
+			addSketchFlags(fs)
+		},
+		run: noArgs(mainTree),
+	},
+	{
+		name: "info",
+		desc: "Print information about sketch files",
+		args: "file.blini...",
+		flags: func(fs *flag.FlagSet) {
+		},
+		run: mainInfo,
+	},
+	{
+		name:     "merge",
+		desc:     "Merge sketch files into one",
+		args:     "file.blini...",
+		required: []string{"o"},
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(oFile, "o", "", "Output sketch `file`")
+		},
+		run: mainMerge,
+	},
+}
+
+// Defines the input flag of commands that take a single input.
+// If sketches is true, the input may also be a sketch file.
+func addInputFlag(fs *flag.FlagSet, sketches bool) {
+	usage := "Input sequence `file`, directory, glob or manifest"
+	if sketches {
+		usage += "; or a sketch file"
+	}
+	fs.StringVar(inFile, "i", "", usage)
+}
+
+// Returns an error if the input is a sketch file, for commands that
+// need the input sequences.
+func checkSequenceInput(file string) error {
+	if strings.HasSuffix(file, blini.SketchFileSuffix) {
+		return fmt.Errorf("input should be sequences, not a sketch file: %s",
+			file)
+	}
+	return nil
+}
+
+// Defines the input flags of commands that take a query and a reference.
+func addSearchInputFlags(fs *flag.FlagSet) {
+	fs.StringVar(qFile, "q", "",
+		"Query sequence `file`, directory, glob or manifest")
+	fs.StringVar(rFile, "r", "",
+		"Reference sequence `file`, directory, glob or manifest; "+
+			"or a sketch file")
+}
+
+// Defines the flags of similarity calculation.
+func addSimFlags(fs *flag.FlagSet) {
+	fs.BoolVar(contn, "c", false, "Use containment rather than full match")
+	fs.Float64Var(minSim, "m", 0.9, "Minimum `similarity` for match")
+}
+
+// Defines the abundance flag, for commands that use abundances.
+func addAbundanceFlag(fs *flag.FlagSet) {
+	fs.BoolVar(abundance, "a", false,
+		"Track kmer abundances and use abundance-weighted similarity")
+}
+
+// Defines the flags of sequence sketching.
+func addSketchFlags(fs *flag.FlagSet) {
+	fs.Uint64Var(scale, "s", 100, "Use 1/`scale` of the kmers")
+	intBetweenVar(fs, kmerLen, "k", 21, "K-mer `length`",
+		1, math.MaxInt)
+	intBetweenVar(fs, nThreads, "t", 1,
+		"Number of `threads` to use", 1, math.MaxInt)
+	intBetweenVar(fs, minAbund, "ma", 1,
+		"Discard kmers that appear less than `count` times", 1, math.MaxInt)
+	intBetweenVar(fs, minQual, "mq", 0,
+		"Mask fastq bases with `quality` below this value", 0, math.MaxInt)
+	regexpVar(fs, groupRegex, "gr", nil,
+		"Group records into genomes by the first match of this `regex` "+
+			"in their names")
+	fs.BoolVar(groupFile, "gf", false,
+		"Group all records in a file into one genome")
+	fs.StringVar(groupMap, "gm", "",
+		"Group records into genomes using a TSV `file` "+
+			"of record name and genome name")
+}
+
+// Defines an int flag with bounds, stored in p.
+func intBetweenVar(fs *flag.FlagSet, p *int, name string, value int,
+	usage string, minVal, maxVal int) {
+	*p = value
+	fs.Var(&intBetween{p, minVal, maxVal}, name, usage)
+}
+
+// An int flag value with bounds.
+type intBetween struct {
+	p              *int
+	minVal, maxVal int
+}
+
+func (v *intBetween) String() string {
+	if v.p == nil { // Zero value, used by flag to detect defaults.
+		return ""
+	}
+	return strconv.Itoa(*v.p)
+}
+
+func (v *intBetween) Set(s string) error {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	if i < v.minVal || i > v.maxVal {
+		return fmt.Errorf("got %d, want %d-%d", i, v.minVal, v.maxVal)
+	}
+	*v.p = i
+	return nil
+}
+
+// Defines a string flag that must have one of the given values,
+// stored in p. The usage should list the allowed values.
+func oneOfVar(fs *flag.FlagSet, p *string, name string, value string,
+	usage string, of ...string) {
+	*p = value
+	fs.Var(&oneOf{p, of}, name, usage)
+}
+
+// A string flag value that must be one of the given values.
+type oneOf struct {
+	p  *string
+	of []string
+}
+
+func (v *oneOf) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return *v.p
+}
+
+func (v *oneOf) Set(s string) error {
+	if !slices.Contains(v.of, s) {
+		return fmt.Errorf("want one of %v", v.of)
+	}
+	*v.p = s
+	return nil
+}
+
+// Defines a regular expression flag, stored in p.
+func regexpVar(fs *flag.FlagSet, p **regexp.Regexp, name string,
+	value *regexp.Regexp, usage string) {
+	*p = value
+	fs.Var(&regexpValue{p}, name, usage)
+}
+
+// A regular expression flag value.
+type regexpValue struct {
+	p **regexp.Regexp
+}
+
+func (v *regexpValue) String() string {
+	if v.p == nil || *v.p == nil {
+		return ""
+	}
+	return (*v.p).String()
+}
+
+func (v *regexpValue) Set(s string) error {
+	r, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	*v.p = r
+	return nil
+}
+
+// Wraps a main function of a command that takes no positional arguments.
+func noArgs(f func() error) func([]string) error {
+	return func([]string) error { return f() }
+}
+
 func main() {
-	flag.Parse()
 	debug.SetGCPercent(20)
 
-	var err error
-	if *qFile != "" && *rFile != "" {
-		err = mainSearch()
-	} else if *qFile != "" {
-		err = mainCluster()
-	} else if *rFile != "" {
-		err = mainSketch()
-	} else {
-		fmt.Printf("Blini (%s)\n\n", version)
-		fmt.Println("Please select -q for clustering, -r for sketching,",
-			"or both for searching.")
-		flag.PrintDefaults()
+	if len(os.Args) < 2 {
+		printUsage()
 		os.Exit(1)
 	}
-	if err != nil {
+	i := slices.IndexFunc(commands, func(c command) bool {
+		return c.name == os.Args[1]
+	})
+	if i == -1 {
+		if os.Args[1] != "help" && os.Args[1] != "-h" {
+			fmt.Printf("Unknown command: %q\n\n", os.Args[1])
+		}
+		printUsage()
+		os.Exit(1)
+	}
+	cmd := commands[i]
+
+	fs := flag.NewFlagSet("blini "+cmd.name, flag.ExitOnError)
+	fs.Usage = func() {
+		usage := strings.TrimSpace("blini " + cmd.name + " [flags] " + cmd.args)
+		fmt.Fprintf(fs.Output(), "Usage: %s\n\n%s.\n\n", usage, cmd.desc)
+		fs.PrintDefaults()
+	}
+	cmd.flags(fs)
+	fs.Parse(os.Args[2:])
+	if err := checkArgs(fs, cmd); err != nil {
+		fmt.Printf("ERROR: %v\n\n", err)
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if err := cmd.run(fs.Args()); err != nil {
 		fmt.Println("ERROR:", err)
 		os.Exit(2)
 	}
 }
 
-// Returns the jaccard/containment jaccard.
-func jaccard(a, b []uint64) float64 {
-	if *contn {
-		return sketching.Containment(a, b)
-	} else {
-		return sketching.Jaccard(a, b)
+// Checks that the required flags and positional arguments are present.
+func checkArgs(fs *flag.FlagSet, cmd command) error {
+	for _, name := range cmd.required {
+		if fs.Lookup(name).Value.String() == "" {
+			return fmt.Errorf("missing -%s", name)
+		}
 	}
+	if cmd.args == "" && fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %q", fs.Args())
+	}
+	if cmd.args != "" && fs.NArg() == 0 {
+		return fmt.Errorf("missing arguments: %s", cmd.args)
+	}
+	return nil
 }
 
-// Returns a specialized distance.
-func myDist(a, b []uint64, alen, blen int) float64 {
-	if *contn {
-		return mash.FromJaccard(sketching.Containment(a, b), kmerLen)
-	} else {
-		return sketching.MyDist(a, b, alen, blen, kmerLen)
+// Prints the list of available commands.
+func printUsage() {
+	fmt.Printf("Blini (%s)\n\n", blini.Version)
+	fmt.Println("Usage: blini <command> [flags]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	for _, c := range commands {
+		fmt.Printf("  %-8s %s\n", c.name, c.desc)
 	}
+	fmt.Println()
+	fmt.Println("Run 'blini <command> -h' for help on a command.")
 }
+
+// Returns the sketching options given by the flags.
+func sketchOptions() (blini.SketchOptions, error) {
+	opts := blini.SketchOptions{
+		K:            *kmerLen,
+		Scale:        *scale,
+		Threads:      *nThreads,
+		Abundance:    *abundance,
+		MinAbundance: *minAbund,
+		MinQuality:   *minQual,
+		GroupRegexp:  *groupRegex,
+		GroupByFile:  *groupFile,
+	}
+	nset := 0
+	for _, b := range []bool{*groupRegex != nil, *groupFile, *groupMap != ""} {
+		if b {
+			nset++
+		}
+	}
+	if nset > 1 {
+		return opts, fmt.Errorf("only one of -gr, -gf and -gm may be set")
+	}
+	if *groupMap != "" {
+		m, err := blini.ReadGroupMap(*groupMap)
+		if err != nil {
+			return opts, err
+		}
+		opts.GroupMap = m
+	}
+	return opts, nil
+}
+
+// Returns the similarity options given by the flags.
+func simOptions() blini.SimilarityOptions {
+	return blini.SimilarityOptions{Containment: *contn, Abundance: *abundance}
+}
+
+// Reads or sketches the given input, according to its suffix,
+// reporting progress.
+func loadSketches(file string) (*blini.Sketches, error) {
+	if strings.HasSuffix(file, blini.SketchFileSuffix) {
+		fmt.Println("Reading prepared sketches")
+		return blini.CollectSketches(withProgress(blini.ReadSketches(file)))
+	}
+	opts, err := sketchOptions()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Sketching sequences")
+	return blini.CollectSketches(withProgress(blini.SketchInput(file, opts)))
+}
+
+// Loads sketches using loadSketches and indexes them.
+// If the input is a sketch file with an index file, reads the index.
+// A memory-mapped index is preferred over a regular one.
+func loadReference(file string) (*blini.Reference, error) {
+	if idxFile, ok := blini.MappedIndexFile(file); ok {
+		fmt.Println("Mapping prepared sketches and index")
+		return blini.OpenMappedReference(file, idxFile)
+	}
+	sk, err := loadSketches(file)
+	if err != nil {
+		return nil, err
+	}
+	if idxFile, ok := blini.IndexFile(file); ok {
+		fmt.Println("Reading index")
+		return blini.ReadReference(sk, idxFile)
+	}
+	fmt.Println("Indexing")
+	return blini.NewReference(sk), nil
+}
+
+// Reports the progress of an iteration.
+func withProgress[T any](seq iter.Seq2[T, error]) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		pt := ptimer.New()
+		for x, err := range seq {
+			if !yield(x, err) || err != nil {
+				return
+			}
+			pt.Inc()
+		}
+		pt.Done()
+	}
+}
+
+// Creates the given output file. If file is empty,
+// returns a writer that discards its input.
+func createOutput(file string) (io.WriteCloser, error) {
+	if file == "" {
+		return nopCloser{io.Discard}, nil
+	}
+	return aio.Create(file)
+}
+
+// Wraps a writer with a no-op Close method.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
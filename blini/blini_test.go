@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestCheckArgs(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []string
+		ok   bool
+	}{
+		{"search", []string{"-q", "a", "-r", "b"}, true},
+		{"search", []string{"-q", "a"}, false},
+		{"search", []string{"-q", "a", "-r", "b", "c"}, false},
+		{"cluster", []string{"-i", "a"}, true},
+		{"cluster", []string{}, false},
+		{"info", []string{"a", "b"}, true},
+		{"info", []string{}, false},
+		{"merge", []string{"-o", "a", "b"}, true},
+		{"merge", []string{"b"}, false},
+	}
+	for _, test := range tests {
+		for _, c := range commands {
+			if c.name != test.cmd {
+				continue
+			}
+			fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+			c.flags(fs)
+			if err := fs.Parse(test.args); err != nil {
+				t.Fatalf("Parse(%q) failed: %v", test.args, err)
+			}
+			if err := checkArgs(fs, c); (err == nil) != test.ok {
+				t.Errorf("checkArgs(%s %q)=%v, want ok=%v",
+					test.cmd, test.args, err, test.ok)
+			}
+		}
+	}
+}
+
+func TestGatherFlags(t *testing.T) {
+	for _, c := range commands {
+		if c.name != "gather" {
+			continue
+		}
+		fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+		c.flags(fs)
+		for _, name := range []string{"a", "c", "m"} {
+			if fs.Lookup(name) != nil {
+				t.Errorf("gather defines -%s, want not", name)
+			}
+		}
+	}
+}
+
+func TestFlagDefaults(t *testing.T) {
+	var out strings.Builder
+	for _, c := range commands {
+		if c.name != "search" {
+			continue
+		}
+		fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+		c.flags(fs)
+		fs.SetOutput(&out)
+		fs.PrintDefaults()
+	}
+	for _, want := range []string{
+		"K-mer length (default 21)",
+		"Mask fastq bases with quality below this value (default 0)",
+		"Output format: csv, tsv or jsonl (default csv)\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("PrintDefaults()=%q, want it to contain %q",
+				out.String(), want)
+		}
+	}
+}
@@ -3,17 +3,17 @@
 package main
 
 import (
-	"cmp"
+	"context"
 	"fmt"
-	"maps"
+	"io"
 	"slices"
+	"strconv"
+	"strings"
 
-	"github.com/fluhus/biostuff/formats/fasta"
-	"github.com/fluhus/biostuff/mash/v2"
-	"github.com/fluhus/blini/sketching"
+	"github.com/fluhus/blini"
 	"github.com/fluhus/gostuff/aio"
+	"github.com/fluhus/gostuff/csvx"
 	"github.com/fluhus/gostuff/jio"
-	"github.com/fluhus/gostuff/ptimer"
 	"github.com/fluhus/gostuff/sets"
 	"github.com/fluhus/gostuff/snm"
 )
@@ -24,146 +24,554 @@ func mainCluster() error {
 	fmt.Println("CLUSTERING OPERATION")
 	fmt.Println("--------------------")
 	fmt.Println("Scale:", *scale)
+	fmt.Println("K:", *kmerLen)
+	fmt.Println("Threads:", *nThreads)
 	fmt.Println("Min sim:", *minSim)
-
-	if *unmatched {
-		return fmt.Errorf("flag -u is for search, not for clustering")
+	fmt.Println("Mode:", *clusterMode)
+	fmt.Println("Representatives:", *repSelection)
+	fmt.Println("Reassign:", *reassign)
+	fmt.Println("Format:", *clusterFormat)
+	if *prevClusters != "" {
+		fmt.Println("Previous clusters:", *prevClusters)
+	}
+	if *levels != "" {
+		fmt.Println("Levels:", *levels)
 	}
 
+	if err := checkSequenceInput(*inFile); err != nil {
+		return err
+	}
+	if *reassign && *clusterMode != modeGreedy {
+		return fmt.Errorf("-reassign requires greedy clustering mode")
+	}
+	if (*repSelection == repPriority) != (*priorityFile != "") {
+		return fmt.Errorf("-priority should be given if and only if " +
+			"-rep is priority-file")
+	}
+	opts, err := sketchOptions()
+	if err != nil {
+		return err
+	}
+	if *prevClusters != "" {
+		if *levels != "" {
+			return fmt.Errorf("-levels cannot be used with -prev")
+		}
+		return extendClusters(opts)
+	}
+	if *levels != "" {
+		return clusterLevels(opts)
+	}
 	fmt.Println("Sketching sequences")
-	sk, err := collectSketches(sketchFile(*qFile))
+	sk, err := blini.CollectSketches(
+		withProgress(blini.SketchInput(*inFile, opts)))
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("Indexing")
-	pt := ptimer.New()
-	idx := sketching.NewIndex(*scale * idxScale)
-	for i, s := range sk.skch {
-		idx.Add(s, i)
-		pt.Inc()
+	copts, err := clusterOptions(sk)
+	if err != nil {
+		return err
 	}
-	pt.Done()
-
-	idx.Clean()
-
 	fmt.Println("Clustering")
-	perm := sortedPerm(sk.lens, func(a, b int) int {
-		return cmp.Compare(b, a)
-	})
-	friends := 0
-	var clusters [][]int
-	pt = ptimer.NewFunc(func(i int) string {
-		return fmt.Sprintf("%d (%dc %df)", i, len(clusters), friends/i)
-	})
-	for _, i := range perm {
-		s := sk.skch[i]
-		if s == nil {
-			pt.Inc()
-			continue
-		}
-		sk.skch[i] = nil
-		fr := idx.Search(s)
-		friends += len(fr)
-
-		// Create cluster.
-		c := []int{i}
-		for _, f := range fr {
-			if sk.skch[f] == nil {
-				continue
-			}
-			var sim float64
-			if useMyDist {
-				sim = 1 - myDist(sk.skch[f], s, sk.lens[f], sk.lens[i])
-			} else {
-				sim = 1 - mash.FromJaccard(jaccard(sk.skch[f], s), kmerLen)
-			}
-			if sim < *minSim {
-				continue
+	clusters, err := sk.Cluster(context.Background(), copts)
+	if err != nil {
+		return err
+	}
+
+	if *oFile != "" {
+		fmt.Println("Generating output")
+		if err := writeAssignments(*oFile, clusters, sk); err != nil {
+			return err
+		}
+		reps := &blini.Sketches{Scale: sk.Scale, K: sk.K}
+		for _, c := range clusters {
+			if err := reps.Add(sk.At(c.Members[0])); err != nil {
+				return err
 			}
-			c = append(c, f)
-			sk.skch[f] = nil
 		}
-		clusters = append(clusters, c)
-		pt.Inc()
+		if err := writeRepSketches(*oFile, reps); err != nil {
+			return err
+		}
+
+		// Fasta output.
+		fout, err := aio.Create(*oFile + ".fasta")
+		if err != nil {
+			return err
+		}
+		defer fout.Close()
+		if err := writeReps(fout, clusters, sk); err != nil {
+			return err
+		}
+	} else {
+		fmt.Println("No output")
 	}
-	pt.Done()
 
-	{ // TODO(fluhus): Organize this code.
-		alli := sets.Set[int]{}
-		lens := 0
-		for _, c := range clusters {
-			alli.Add(c...)
-			lens += len(c)
+	return nil
+}
+
+// Clustering modes.
+const (
+	modeGreedy     = "greedy"
+	modeSingle     = "single"
+	modeComponents = "components"
+)
+
+// Library clustering modes, by flag value.
+// Connected components of the similarity graph are single-linkage clusters.
+var clusterModes = map[string]blini.ClusterMode{
+	modeGreedy:     blini.Greedy,
+	modeSingle:     blini.SingleLinkage,
+	modeComponents: blini.SingleLinkage,
+}
+
+// Representative selection strategies.
+const (
+	repLongest    = "longest"
+	repShortest   = "shortest"
+	repInputOrder = "input-order"
+	repCentroid   = "centroid"
+	repPriority   = "priority-file"
+)
+
+// Library representative selection strategies, by flag value.
+var repSelections = map[string]blini.RepSelection{
+	repLongest:    blini.Longest,
+	repShortest:   blini.Shortest,
+	repInputOrder: blini.InputOrder,
+	repCentroid:   blini.Centroid,
+	repPriority:   blini.Priority,
+}
+
+// Returns the clustering options given by the flags,
+// for clustering the given sketches.
+func clusterOptions(sk *blini.Sketches) (blini.ClusterOptions, error) {
+	opts := blini.ClusterOptions{
+		SimilarityOptions: simOptions(),
+		Mode:              clusterModes[*clusterMode],
+		Rep:               repSelections[*repSelection],
+		MinSimilarity:     *minSim,
+		Reassign:          *reassign,
+	}
+	if opts.Rep == blini.Priority {
+		var err error
+		opts.Priorities, err = readPriorities(*priorityFile, sk.Names)
+		if err != nil {
+			return blini.ClusterOptions{}, err
+		}
+	}
+	return opts, nil
+}
+
+// Returns the priorities of the given names, by their order in the
+// given file, where names are in the first column.
+// Names are matched by their full name or by its first word.
+// Names that are not in the file come after the ones that are.
+func readPriorities(file string, names []string) ([]int, error) {
+	ranks := map[string]int{}
+	for line, err := range csvx.File(file, csvx.TSV) {
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ranks[line[0]]; !ok {
+			ranks[line[0]] = len(ranks)
 		}
-		if lens != len(alli) {
-			fmt.Println("lens!=alli:", lens, len(alli))
+	}
+	return snm.SliceToSlice(names, func(name string) int {
+		if r, ok := ranks[name]; ok {
+			return r
 		}
-		if !maps.Equal(alli, sets.Of(perm...)) {
-			fmt.Println("bad alli")
+		first, _, _ := strings.Cut(name, " ")
+		if r, ok := ranks[first]; ok {
+			return r
 		}
+		return len(ranks)
+	}), nil
+}
+
+// Writes the cluster assignments to a file with the given prefix,
+// in the format given by the -format flag.
+func writeAssignments(prefix string, clusters []blini.Cluster,
+	sk *blini.Sketches) error {
+	switch *clusterFormat {
+	case formatJSON:
+		return jio.Write(prefix+".json", newClusterJSON(clusters, sk))
+	case formatTSV:
+		return writeClusterFile(prefix+".tsv", func(w io.Writer) error {
+			return writeClusterTSV(w, clusters, sk.Names)
+		})
+	case formatClstr:
+		return writeClusterFile(prefix+".clstr", func(w io.Writer) error {
+			return writeClstr(w, clusters, sk)
+		})
+	default:
+		return fmt.Errorf("unsupported cluster format: %q", *clusterFormat)
 	}
+}
 
-	// Sort clusters for deterministic output.
+// Writes the clusters as representative-member pairs, one per line,
+// like MMseqs2's cluster TSV. Each representative is paired with itself.
+func writeClusterTSV(w io.Writer, clusters []blini.Cluster, names []string,
+) error {
 	for _, c := range clusters {
-		slices.Sort(c[1:]) // First element is the representative.
+		rep := names[c.Members[0]]
+		for _, m := range c.Members {
+			if _, err := fmt.Fprintf(w, "%s\t%s\n", rep, names[m]); err != nil {
+				return err
+			}
+		}
 	}
-	slices.SortFunc(clusters, func(a, b []int) int {
-		return cmp.Compare(a[0], b[0])
-	})
+	return nil
+}
 
-	// Create clusters by names.
-	byName := snm.SliceToSlice(clusters, func(c []int) []string {
-		return snm.SliceToSlice(c, func(i int) string {
-			return sk.names[i]
-		})
-	})
+// JSON cluster assignments.
+type clusterJSON struct {
+	ByName       [][]string     `json:"byName"`
+	ByNumber     [][]int        `json:"byNumber"`
+	Similarities [][]float64    `json:"similarities"`
+	Stats        []clusterStats `json:"stats"`
+}
 
-	if *oFile != "" {
-		fmt.Println("Generating output")
-		// JSON output.
-		output := map[string]any{
-			"byNumber": clusters,
-			"byName":   byName,
+// Cluster statistics with JSON field names.
+type clusterStats struct {
+	Size           int     `json:"size"`
+	MinSimilarity  float64 `json:"minSimilarity"`
+	MeanSimilarity float64 `json:"meanSimilarity"`
+	MinLength      int     `json:"minLength"`
+	MaxLength      int     `json:"maxLength"`
+}
+
+// Returns the JSON assignments of the given clusters.
+func newClusterJSON(clusters []blini.Cluster, sk *blini.Sketches,
+) *clusterJSON {
+	cj := &clusterJSON{}
+	for _, c := range clusters {
+		cj.add(c, sk, 0)
+	}
+	return cj
+}
+
+// Adds a cluster, adding offset to its members' serial numbers.
+func (cj *clusterJSON) add(c blini.Cluster, sk *blini.Sketches, offset int) {
+	cj.ByNumber = append(cj.ByNumber,
+		snm.SliceToSlice(c.Members, func(i int) int { return i + offset }))
+	cj.ByName = append(cj.ByName,
+		snm.SliceToSlice(c.Members, func(i int) string { return sk.Names[i] }))
+	cj.Similarities = append(cj.Similarities, c.Similarities)
+	cj.Stats = append(cj.Stats, clusterStats(c.Stats(sk)))
+}
+
+// Adds a member to cluster i, with the given serial number.
+func (cj *clusterJSON) join(i, number int, name string, sim float64,
+	length int) {
+	cj.ByNumber[i] = append(cj.ByNumber[i], number)
+	cj.ByName[i] = append(cj.ByName[i], name)
+	cj.Similarities[i] = append(cj.Similarities[i], sim)
+
+	st := &cj.Stats[i]
+	if st.Size == 1 {
+		st.MinSimilarity, st.MeanSimilarity = sim, sim
+	} else {
+		st.MinSimilarity = min(st.MinSimilarity, sim)
+		st.MeanSimilarity = (st.MeanSimilarity*float64(st.Size-1) + sim) /
+			float64(st.Size)
+	}
+	st.Size++
+	st.MinLength = min(st.MinLength, length)
+	st.MaxLength = max(st.MaxLength, length)
+}
+
+// Returns the number of clustered sequences.
+func (cj *clusterJSON) size() int {
+	n := 0
+	for _, c := range cj.ByNumber {
+		n += len(c)
+	}
+	return n
+}
+
+// Checks that the assignments are consistent.
+func (cj *clusterJSON) check() error {
+	n := len(cj.ByNumber)
+	if len(cj.ByName) != n || len(cj.Similarities) != n ||
+		len(cj.Stats) != n {
+		return fmt.Errorf("mismatching numbers of clusters: "+
+			"byNumber=%d byName=%d similarities=%d stats=%d",
+			n, len(cj.ByName), len(cj.Similarities), len(cj.Stats))
+	}
+	for i := range n {
+		m := len(cj.ByNumber[i])
+		if m == 0 || len(cj.ByName[i]) != m ||
+			len(cj.Similarities[i]) != m || cj.Stats[i].Size != m {
+			return fmt.Errorf("cluster #%d: mismatching numbers of members",
+				i+1)
+		}
+	}
+	return nil
+}
+
+// Clusters the input on top of the clusters of a previous run.
+// Cluster numbers (positions in the output) are kept, and new clusters
+// are added after them.
+func extendClusters(opts blini.SketchOptions) error {
+	if *clusterFormat != formatJSON {
+		return fmt.Errorf("adding to previous clusters supports only " +
+			"json format")
+	}
+	fmt.Println("Reading previous clusters")
+	cj, err := jio.ReadAs[*clusterJSON](*prevClusters + ".json")
+	if err != nil {
+		return err
+	}
+	if err := cj.check(); err != nil {
+		return fmt.Errorf("%s: %w", *prevClusters+".json", err)
+	}
+	reps, err := loadSketches(*prevClusters + blini.SketchFileSuffix)
+	if err != nil {
+		return err
+	}
+	if reps.Len() != len(cj.ByNumber) {
+		return fmt.Errorf("found %d representatives for %d clusters",
+			reps.Len(), len(cj.ByNumber))
+	}
+	if reps.Len() > 0 && (reps.Counts != nil) != *abundance {
+		if *abundance {
+			return fmt.Errorf("-a was given but the previous clusters " +
+				"were created without it")
 		}
-		if err := jio.Write(*oFile+".json", output); err != nil {
+		return fmt.Errorf("the previous clusters were created with -a, " +
+			"use it here too")
+	}
+	fmt.Println("Number of previous clusters:", reps.Len())
+
+	opts.K, opts.Scale = reps.K, reps.Scale
+	fmt.Println("Sketching sequences")
+	sk, err := blini.CollectSketches(
+		withProgress(blini.SketchInput(*inFile, opts)))
+	if err != nil {
+		return err
+	}
+
+	copts, err := clusterOptions(sk)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Clustering")
+	ext, err := sk.ExtendClusters(context.Background(), reps, copts)
+	if err != nil {
+		return err
+	}
+	fmt.Println("New clusters:", len(ext.New))
+
+	if *oFile == "" {
+		fmt.Println("No output")
+		return nil
+	}
+	fmt.Println("Generating output")
+	// New sequences are numbered after the previous ones.
+	offset := cj.size()
+	for i, joined := range ext.Joined {
+		for j, m := range joined {
+			cj.join(i, m+offset, sk.Names[m], ext.Similarities[i][j],
+				sk.Lengths[m])
+		}
+	}
+	for _, c := range ext.New {
+		cj.add(c, sk, offset)
+		if err := reps.Add(sk.At(c.Members[0])); err != nil {
 			return err
 		}
+	}
+	if err := jio.Write(*oFile+".json", cj); err != nil {
+		return err
+	}
+	if err := writeRepSketches(*oFile, reps); err != nil {
+		return err
+	}
 
-		// Fasta output.
-		reps := snm.SliceToSlice(clusters, func(a []int) int { return a[0] })
-		fout, err := aio.Create(*oFile + ".fasta")
+	// Fasta output, for new representatives only.
+	fout, err := aio.Create(*oFile + ".fasta")
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	return writeReps(fout, ext.New, sk)
+}
+
+// Clusters the input at each of the similarities given by -levels,
+// and writes each sequence's cluster number at each level.
+func clusterLevels(opts blini.SketchOptions) error {
+	minSims, err := parseLevels(*levels)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Sketching sequences")
+	sk, err := blini.CollectSketches(
+		withProgress(blini.SketchInput(*inFile, opts)))
+	if err != nil {
+		return err
+	}
+
+	copts, err := clusterOptions(sk)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Clustering")
+	lvls, err := sk.ClusterLevels(context.Background(), minSims, copts)
+	if err != nil {
+		return err
+	}
+	for i, clusters := range lvls {
+		fmt.Printf("Clusters at %v: %d\n", minSims[i], len(clusters))
+	}
+
+	if *oFile == "" {
+		fmt.Println("No output")
+		return nil
+	}
+	fmt.Println("Generating output")
+	return writeClusterFile(*oFile+".levels.tsv", func(w io.Writer) error {
+		return writeLevels(w, minSims, lvls, sk.Names)
+	})
+}
+
+// Returns the similarities in the given comma-separated list,
+// in descending order.
+func parseLevels(s string) ([]float64, error) {
+	var result []float64
+	for _, f := range strings.Split(s, ",") {
+		m, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
 		if err != nil {
+			return nil, fmt.Errorf("bad level: %w", err)
+		}
+		result = append(result, m)
+	}
+	slices.Sort(result)
+	slices.Reverse(result)
+	return slices.Compact(result), nil
+}
+
+// Writes a table of sequences and their cluster numbers at each level.
+func writeLevels(w io.Writer, minSims []float64, lvls [][]blini.Cluster,
+	names []string) error {
+	ids := make([][]int, len(names)) // Cluster numbers by sequence.
+	for i := range ids {
+		ids[i] = make([]int, len(lvls))
+	}
+	for l, clusters := range lvls {
+		for c, cl := range clusters {
+			for _, m := range cl.Members {
+				ids[m][l] = c
+			}
+		}
+	}
+
+	header := []string{"number", "name"}
+	for _, m := range minSims {
+		header = append(header, fmt.Sprint(m))
+	}
+	if _, err := fmt.Fprintln(w, strings.Join(header, "\t")); err != nil {
+		return err
+	}
+	for i, name := range names {
+		row := []string{fmt.Sprint(i), name}
+		for _, id := range ids[i] {
+			row = append(row, fmt.Sprint(id))
+		}
+		if _, err := fmt.Fprintln(w, strings.Join(row, "\t")); err != nil {
 			return err
 		}
-		defer fout.Close()
-		i := -1
-		for fa, err := range fasta.File(*qFile) {
+	}
+	return nil
+}
+
+// Writes the representatives' sketches, for adding to the clusters
+// in later runs.
+func writeRepSketches(prefix string, reps *blini.Sketches) error {
+	return writeClusterFile(prefix+blini.SketchFileSuffix,
+		func(w io.Writer) error {
+			return blini.WriteSketches(w, reps)
+		})
+}
+
+// Creates the given file and writes to it using f.
+func writeClusterFile(file string, f func(io.Writer) error) error {
+	fout, err := aio.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := f(fout); err != nil {
+		fout.Close()
+		return err
+	}
+	return fout.Close()
+}
+
+// Writes the clusters in CD-HIT's .clstr format. Representatives are
+// marked with a '*', and other members with their similarity to it.
+// Sequences are named by the first word of their names, like CD-HIT.
+func writeClstr(w io.Writer, clusters []blini.Cluster, sk *blini.Sketches,
+) error {
+	for i, c := range clusters {
+		if _, err := fmt.Fprintf(w, ">Cluster %d\n", i); err != nil {
+			return err
+		}
+		for j, m := range c.Members {
+			name, _, _ := strings.Cut(sk.Names[m], " ")
+			tail := "*"
+			if j > 0 {
+				tail = fmt.Sprintf("at +/%.2f%%", c.Similarities[j]*100)
+			}
+			_, err := fmt.Fprintf(w, "%d\t%dnt, >%s... %s\n",
+				j, sk.Lengths[m], name, tail)
 			if err != nil {
 				return err
 			}
-			if len(reps) == 0 {
-				break
-			}
-			i++
-			if i == reps[0] {
-				if err := fa.Write(fout); err != nil {
+		}
+	}
+	return nil
+}
+
+// Writes the input sequences of the clusters' representatives.
+func writeReps(w io.Writer, clusters []blini.Cluster, sk *blini.Sketches,
+) error {
+	files, err := blini.InputFiles(*inFile)
+	if err != nil {
+		return err
+	}
+	if files != nil { // Each sketch is an entire file.
+		for _, c := range clusters {
+			file := files[c.Members[0]].Path
+			for fa, err := range blini.SequenceFile(file, 0) {
+				if err != nil {
+					return err
+				}
+				if err := fa.Write(w); err != nil {
 					return err
 				}
-				reps = reps[1:]
 			}
 		}
-	} else {
-		fmt.Println("No output")
+		return nil
 	}
 
+	reps := sets.Set[int]{} // Record numbers of representatives.
+	for _, c := range clusters {
+		reps.Add(sk.Records[c.Members[0]]...)
+	}
+	i := -1
+	for fa, err := range blini.SequenceFile(*inFile, 0) {
+		if err != nil {
+			return err
+		}
+		if len(reps) == 0 {
+			break
+		}
+		i++
+		if reps.Has(i) {
+			if err := fa.Write(w); err != nil {
+				return err
+			}
+			delete(reps, i)
+		}
+	}
 	return nil
 }
-
-// Returns the indexes of slice elements if they were sorted.
-func sortedPerm[T any](s []T, cmp func(T, T) int) []int {
-	return snm.SortedFunc(
-		snm.Slice(len(s), func(i int) int { return i }),
-		func(i, j int) int { return cmp(s[i], s[j]) },
-	)
-}
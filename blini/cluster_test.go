@@ -1,16 +1,125 @@
 package main
 
 import (
-	"cmp"
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
 	"slices"
 	"testing"
+
+	"github.com/fluhus/blini"
 )
 
-func TestSortedPerm(t *testing.T) {
-	input := []string{"a", "g", "d", "b"}
-	want := []int{0, 3, 2, 1}
-	got := sortedPerm(input, cmp.Compare)
+func TestWriteClusterTSV(t *testing.T) {
+	names := []string{"a", "b", "c", "d"}
+	clusters := []blini.Cluster{{Members: []int{2, 0, 3}}, {Members: []int{1}}}
+	buf := &bytes.Buffer{}
+	if err := writeClusterTSV(buf, clusters, names); err != nil {
+		t.Fatalf("writeClusterTSV(...) failed: %v", err)
+	}
+	want := "c\tc\nc\ta\nc\td\nb\tb\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("writeClusterTSV(...)=%q, want %q", got, want)
+	}
+}
+
+func TestWriteClstr(t *testing.T) {
+	sk := &blini.Sketches{
+		Names:   []string{"a x", "b", "c y z"},
+		Lengths: []int{90, 100, 95},
+	}
+	clusters := []blini.Cluster{
+		{Members: []int{1, 2}, Similarities: []float64{1, 0.9712}},
+		{Members: []int{0}, Similarities: []float64{1}},
+	}
+	buf := &bytes.Buffer{}
+	if err := writeClstr(buf, clusters, sk); err != nil {
+		t.Fatalf("writeClstr(...) failed: %v", err)
+	}
+	want := ">Cluster 0\n" +
+		"0\t100nt, >b... *\n" +
+		"1\t95nt, >c... at +/97.12%\n" +
+		">Cluster 1\n" +
+		"0\t90nt, >a... *\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("writeClstr(...)=%q, want %q", got, want)
+	}
+}
+
+func TestClusterJSONJoin(t *testing.T) {
+	sk := &blini.Sketches{Names: []string{"a", "b"}, Lengths: []int{100, 90}}
+	cj := newClusterJSON([]blini.Cluster{
+		{Members: []int{0}, Similarities: []float64{1}},
+		{Members: []int{1}, Similarities: []float64{1}},
+	}, sk)
+	cj.join(1, 5, "c", 0.9, 80)
+	cj.join(1, 6, "d", 0.8, 95)
+	if err := cj.check(); err != nil {
+		t.Fatalf("check() failed: %v", err)
+	}
+	want := &clusterJSON{
+		ByName:       [][]string{{"a"}, {"b", "c", "d"}},
+		ByNumber:     [][]int{{0}, {1, 5, 6}},
+		Similarities: [][]float64{{1}, {1, 0.9, 0.8}},
+		Stats: []clusterStats{
+			{1, 1, 1, 100, 100},
+			{3, 0.8, 0.85, 80, 95},
+		},
+	}
+	if got := cj.Stats[1].MeanSimilarity; math.Abs(got-0.85) > 1e-9 {
+		t.Fatalf("MeanSimilarity=%v, want 0.85", got)
+	}
+	cj.Stats[1].MeanSimilarity = 0.85
+	if !reflect.DeepEqual(cj, want) {
+		t.Fatalf("join(...)=%v, want %v", cj, want)
+	}
+}
+
+func TestParseLevels(t *testing.T) {
+	got, err := parseLevels("0.97, 0.999,0.99,0.97")
+	if err != nil {
+		t.Fatalf("parseLevels(...) failed: %v", err)
+	}
+	want := []float64{0.999, 0.99, 0.97}
+	if !slices.Equal(got, want) {
+		t.Fatalf("parseLevels(...)=%v, want %v", got, want)
+	}
+	if _, err := parseLevels("0.9,a"); err == nil {
+		t.Fatalf("parseLevels(\"0.9,a\") succeeded, want error")
+	}
+}
+
+func TestWriteLevels(t *testing.T) {
+	lvls := [][]blini.Cluster{
+		{{Members: []int{0, 1}}, {Members: []int{2}}},
+		{{Members: []int{2, 0, 1}}},
+	}
+	buf := &bytes.Buffer{}
+	err := writeLevels(buf, []float64{0.99, 0.9}, lvls, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatalf("writeLevels(...) failed: %v", err)
+	}
+	want := "number\tname\t0.99\t0.9\n" +
+		"0\ta\t0\t0\n1\tb\t0\t0\n2\tc\t1\t0\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("writeLevels(...)=%q, want %q", got, want)
+	}
+}
+
+func TestReadPriorities(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "priorities.tsv")
+	data := []byte("c\tRefSeq\na\nc\n")
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		t.Fatalf("WriteFile(%q) failed: %v", file, err)
+	}
+	got, err := readPriorities(file, []string{"a x", "b", "c"})
+	if err != nil {
+		t.Fatalf("readPriorities(%q) failed: %v", file, err)
+	}
+	want := []int{1, 2, 0}
 	if !slices.Equal(got, want) {
-		t.Fatalf("sortedPerm(%q)=%v, want %v", input, got, want)
+		t.Fatalf("readPriorities(%q)=%v, want %v", file, got, want)
 	}
 }
@@ -0,0 +1,165 @@
+// Distance matrix logic.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/fluhus/blini"
+	"github.com/fluhus/gostuff/ppln"
+	"github.com/fluhus/gostuff/ptimer"
+)
+
+// Output formats for distance matrices.
+const (
+	distPhylip = "phylip" // Lower-triangular PHYLIP.
+	distTSV    = "tsv"    // Dense square matrix.
+	distEdges  = "edges"  // Sparse edge list.
+)
+
+// Main function for distance matrix operation.
+func mainDist() error {
+	fmt.Println("-------------------")
+	fmt.Println("DISTANCES OPERATION")
+	fmt.Println("-------------------")
+	fmt.Println("Format:", *distFormat)
+	if *distFormat == distEdges {
+		fmt.Println("Min sim:", *minSim)
+	}
+	fmt.Println("Threads:", *nThreads)
+
+	ref, err := loadReference(*inFile)
+	if err != nil {
+		return err
+	}
+	defer ref.Close()
+	sk := ref.Sketches
+	fmt.Println("Scale:", sk.Scale)
+	fmt.Println("K:", sk.K)
+
+	fmt.Println("Calculating distances")
+	fout, err := createOutput(*oFile)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	return writeDistances(fout, ref, *distFormat)
+}
+
+// Writes the distances between all pairs of sketches in the given format.
+// Pairs that are not found by the index get a distance of 1.
+func writeDistances(w io.Writer, ref *blini.Reference, format string,
+) error {
+	sk := ref.Sketches
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	n := sk.Len()
+	switch format {
+	case distPhylip:
+		fmt.Fprintln(bw, n)
+	case distTSV:
+		for _, name := range sk.Names {
+			fmt.Fprint(bw, "\t", name)
+		}
+		fmt.Fprintln(bw)
+	case distEdges:
+		fmt.Fprintln(bw, "name1\tname2\tdistance")
+	default:
+		return fmt.Errorf("unsupported distance format: %q", format)
+	}
+
+	pt := ptimer.New()
+	err := ppln.Serial(*nThreads, ppln.RangeInput(0, n),
+		func(i, _, _ int) (string, error) {
+			return distRow(i, ref, format)
+		}, func(row string) error {
+			pt.Inc()
+			_, err := bw.WriteString(row)
+			return err
+		})
+	if err != nil {
+		return err
+	}
+	pt.Done()
+	return nil
+}
+
+// Returns the output text of the i'th sketch's distances.
+func distRow(i int, ref *blini.Reference, format string) (string, error) {
+	sk := ref.Sketches
+	cands, dists, err := candDists(i, ref)
+	if err != nil {
+		return "", err
+	}
+	dist := func(j int) float64 {
+		if j == i {
+			return 0
+		}
+		if d, ok := dists[j]; ok {
+			return d
+		}
+		return 1
+	}
+
+	buf := &strings.Builder{}
+	switch format {
+	case distPhylip:
+		buf.WriteString(phylipName(sk.Names[i]))
+		for j := range i {
+			fmt.Fprintf(buf, " %.6f", dist(j))
+		}
+		buf.WriteByte('\n')
+	case distTSV:
+		buf.WriteString(sk.Names[i])
+		for j := range sk.Hashes {
+			fmt.Fprintf(buf, "\t%.6f", dist(j))
+		}
+		buf.WriteByte('\n')
+	case distEdges:
+		for _, j := range cands {
+			if j < i || 1-dists[j] < *minSim {
+				continue
+			}
+			fmt.Fprintf(buf, "%s\t%s\t%.6f\n",
+				sk.Names[i], sk.Names[j], dists[j])
+		}
+	}
+	return buf.String(), nil
+}
+
+// Returns the sorted candidates of the i'th sketch (excluding itself)
+// and the distances to them.
+// Containment is not symmetric, so its distances average both directions.
+func candDists(i int, ref *blini.Reference,
+) ([]int, map[int]float64, error) {
+	sk := ref.Sketches
+	opts := simOptions()
+	cands := ref.Candidates(sk.Hashes[i])
+	cands = slices.DeleteFunc(cands, func(j int) bool { return j == i })
+	dists := make(map[int]float64, len(cands))
+	for _, j := range cands {
+		sim, err := blini.Similarity(sk.At(i), sk.At(j), opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		if opts.Containment {
+			rsim, err := blini.Similarity(sk.At(j), sk.At(i), opts)
+			if err != nil {
+				return nil, nil, err
+			}
+			sim = (sim + rsim) / 2
+		}
+		dists[j] = 1 - sim
+	}
+	return cands, dists, nil
+}
+
+// Returns a name with whitespaces replaced, for PHYLIP output.
+func phylipName(name string) string {
+	return strings.Join(strings.Fields(name), "_")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/fluhus/blini"
+)
+
+func TestWriteDistances(t *testing.T) {
+	defer func(n int) { *nThreads = n }(*nThreads)
+	*nThreads = 1
+
+	s := []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	sk := &blini.Sketches{
+		Hashes:  [][]uint64{s, s, {20, 21, 22}},
+		Lengths: []int{10, 10, 3},
+		Names:   []string{"a", "b b", "c"},
+		Records: make([][]int, 3),
+		Scale:   1,
+		K:       21,
+	}
+	ref := blini.NewReference(sk)
+	sim, err := blini.Similarity(sk.At(0), sk.At(1), blini.SimilarityOptions{})
+	if err != nil {
+		t.Fatalf("Similarity(...) failed: %v", err)
+	}
+	d := fmt.Sprintf("%.6f", 1-sim)
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{distPhylip, "3\na\nb_b " + d + "\nc 1.000000 1.000000\n"},
+		{distTSV, "\ta\tb b\tc\n" +
+			"a\t0.000000\t" + d + "\t1.000000\n" +
+			"b b\t" + d + "\t0.000000\t1.000000\n" +
+			"c\t1.000000\t1.000000\t0.000000\n"},
+		{distEdges, "name1\tname2\tdistance\na\tb b\t" + d + "\n"},
+	}
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		if err := writeDistances(buf, ref, test.format); err != nil {
+			t.Fatalf("writeDistances(%q) failed: %v", test.format, err)
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("writeDistances(%q)=%q, want %q",
+				test.format, got, test.want)
+		}
+	}
+}
+
+func TestCandDists_containment(t *testing.T) {
+	defer func(c bool) { *contn = c }(*contn)
+	*contn = true
+	sk := &blini.Sketches{
+		Hashes:  [][]uint64{{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, {1, 2, 3, 4, 5}},
+		Lengths: []int{10, 5},
+		Names:   []string{"a", "b"},
+		Records: make([][]int, 2),
+		Scale:   1,
+		K:       21,
+	}
+	ref := blini.NewReference(sk)
+	_, d0, err := candDists(0, ref)
+	if err != nil {
+		t.Fatalf("candDists(0) failed: %v", err)
+	}
+	_, d1, err := candDists(1, ref)
+	if err != nil {
+		t.Fatalf("candDists(1) failed: %v", err)
+	}
+	if d0[1] != d1[0] {
+		t.Errorf("candDists(0)[1]=%f, candDists(1)[0]=%f, want equal",
+			d0[1], d1[0])
+	}
+}
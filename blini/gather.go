@@ -0,0 +1,159 @@
+// Gather logic.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+
+	"github.com/fluhus/blini"
+	"github.com/fluhus/gostuff/heaps"
+	"github.com/fluhus/gostuff/ppln"
+	"github.com/fluhus/gostuff/ptimer"
+	"github.com/fluhus/gostuff/sets"
+)
+
+// Main function for gather operation.
+func mainGather() error {
+	fmt.Println("----------------")
+	fmt.Println("GATHER OPERATION")
+	fmt.Println("----------------")
+	ref, err := loadReference(*rFile)
+	if err != nil {
+		return err
+	}
+	defer ref.Close()
+	sk := ref.Sketches
+	fmt.Println("Scale:", sk.Scale)
+	fmt.Println("K:", sk.K)
+	fmt.Println("Min shared hashes:", *gatherMin)
+	fmt.Println("Threads:", *nThreads)
+
+	qopts, err := sketchOptions()
+	if err != nil {
+		return err
+	}
+	qopts.K, qopts.Scale = sk.K, sk.Scale
+
+	fmt.Println("Gathering")
+	fout, err := createOutput(*oFile)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	out := csv.NewWriter(fout)
+	defer out.Flush()
+
+	out.Write([]string{"query", "rank", "reference", "f_unique_to_query",
+		"f_orig_query", "f_match", "intersect_hashes"})
+
+	var matches int
+	pt := ptimer.NewFunc(func(i int) string {
+		return fmt.Sprintf("%d (%d matches)", i, matches)
+	})
+	err = ppln.Serial(*nThreads, blini.SketchInput(*qFile, qopts),
+		func(e blini.Sketch, i, g int) ([][]string, error) {
+			return gatherQuery(e, sk, ref.Candidates(e.Hashes)), nil
+		}, func(rows [][]string) error {
+			matches += len(rows)
+			for _, row := range rows {
+				if err := out.Write(row); err != nil {
+					return err
+				}
+			}
+			pt.Inc()
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	pt.Done()
+
+	return nil
+}
+
+// A single reference picked by gather.
+type gatherMatch struct {
+	ref     int // Reference serial number.
+	unique  int // Number of query hashes first explained by this reference.
+	overlap int // Number of query hashes shared with this reference.
+}
+
+// Runs gather on a single query and returns its output rows.
+func gatherQuery(e blini.Sketch, sk *blini.Sketches, cands []int,
+) [][]string {
+	var rows [][]string
+	for i, m := range gather(e.Hashes, sk.Hashes, cands, *gatherMin) {
+		nq, nr := float64(len(e.Hashes)), float64(len(sk.Hashes[m.ref]))
+		rows = append(rows, []string{
+			e.Name,
+			fmt.Sprint(i + 1),
+			sk.Names[m.ref],
+			fmt.Sprintf("%.4f", float64(m.unique)/nq),
+			fmt.Sprintf("%.4f", float64(m.overlap)/nq),
+			fmt.Sprintf("%.4f", float64(m.overlap)/nr),
+			fmt.Sprint(m.overlap),
+		})
+	}
+	return rows
+}
+
+// Greedily picks the candidate references that explain the most query
+// hashes, removing the hashes of each pick from the query.
+// Stops when no candidate explains at least minShared remaining hashes.
+func gather(q []uint64, refs [][]uint64, cands []int, minShared int,
+) []gatherMatch {
+	type item struct {
+		ref int
+		n   int // Upper bound on shared hashes with the remaining query.
+	}
+	h := heaps.New(func(a, b item) bool {
+		if a.n != b.n {
+			return a.n > b.n
+		}
+		return a.ref < b.ref
+	})
+	overlaps := map[int]int{}
+	for _, c := range cands {
+		n := sets.SortedIntersectionLen(q, refs[c])
+		if n >= minShared && n > 0 {
+			overlaps[c] = n
+			h.Push(item{c, n})
+		}
+	}
+
+	// Lazy greedy: shared counts can only decrease as the query shrinks,
+	// so a recalculated count that remains the maximum is the best pick.
+	var result []gatherMatch
+	remaining := q
+	for h.Len() > 0 {
+		top := h.Pop()
+		n := sets.SortedIntersectionLen(remaining, refs[top.ref])
+		if n < minShared || n == 0 {
+			continue
+		}
+		if n < top.n {
+			h.Push(item{top.ref, n})
+			continue
+		}
+		result = append(result, gatherMatch{top.ref, n, overlaps[top.ref]})
+		remaining = sortedDiff(remaining, refs[top.ref])
+	}
+	return result
+}
+
+// Returns the elements of sorted slice a that are not in sorted slice b.
+func sortedDiff(a, b []uint64) []uint64 {
+	var result []uint64
+	j := 0
+	for _, x := range a {
+		for j < len(b) && b[j] < x {
+			j++
+		}
+		if j < len(b) && b[j] == x {
+			continue
+		}
+		result = append(result, x)
+	}
+	return result
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestGather(t *testing.T) {
+	q := []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	refs := [][]uint64{
+		{1, 2, 3, 20},          // Mostly explained by ref 2.
+		{7, 8, 30, 31},         // 2 unique.
+		{1, 2, 3, 4, 5, 6, 40}, // Best.
+		{50, 51},               // No overlap.
+		{10, 60},               // Below minimum.
+	}
+	want := []gatherMatch{{2, 6, 6}, {1, 2, 2}}
+	got := gather(q, refs, []int{0, 1, 2, 3, 4}, 2)
+	if !slices.Equal(got, want) {
+		t.Fatalf("gather(...)=%v, want %v", got, want)
+	}
+}
+
+func TestSortedDiff(t *testing.T) {
+	tests := []struct {
+		a, b, want []uint64
+	}{
+		{nil, nil, nil},
+		{[]uint64{1, 2, 3}, nil, []uint64{1, 2, 3}},
+		{[]uint64{1, 2, 3}, []uint64{2}, []uint64{1, 3}},
+		{[]uint64{1, 2, 3}, []uint64{0, 1, 2, 3, 4}, nil},
+		{[]uint64{1, 5, 9}, []uint64{2, 5, 8}, []uint64{1, 9}},
+	}
+	for _, test := range tests {
+		if got := sortedDiff(test.a, test.b); !slices.Equal(got, test.want) {
+			t.Errorf("sortedDiff(%v,%v)=%v, want %v",
+				test.a, test.b, got, test.want)
+		}
+	}
+}
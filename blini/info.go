@@ -0,0 +1,104 @@
+// Sketch file inspection and merging logic.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fluhus/blini"
+	"github.com/fluhus/gostuff/aio"
+)
+
+// Main function for the info operation.
+func mainInfo(files []string) error {
+	for _, file := range files {
+		fmt.Println(file)
+		iseg := 0
+		var nrec, nhash, ln int
+		onHeader := func(h blini.SketchFileHeader) {
+			iseg++
+			fmt.Printf("  Segment #%d\n", iseg)
+			fmt.Println("    Version:", h.Version)
+			fmt.Println("    K:", h.K)
+			fmt.Println("    Scale:", h.Scale)
+			fmt.Printf("    Hash: %s (seed %d)\n", h.Hash, h.Seed)
+			fmt.Println("    Abundances:", h.Counts)
+			fmt.Println("    Creator:", h.Creator)
+			fmt.Println("    Created:",
+				time.Unix(h.Created, 0).UTC().Format(time.RFC3339))
+			if h.N >= 0 {
+				fmt.Println("    Records:", h.N)
+			} else {
+				fmt.Println("    Records: not in header")
+			}
+		}
+		for e, err := range blini.ReadSketchesFunc(file, onHeader) {
+			if err != nil {
+				return err
+			}
+			nrec++
+			nhash += len(e.Hashes)
+			ln += e.Length
+		}
+		fmt.Println("  Total records:", nrec)
+		fmt.Println("  Total hashes:", nhash)
+		fmt.Println("  Total sequence length:", ln)
+	}
+	return nil
+}
+
+// Main function for the merge operation.
+func mainMerge(files []string) error {
+	fmt.Println("---------------")
+	fmt.Println("MERGE OPERATION")
+	fmt.Println("---------------")
+	if !strings.HasSuffix(*oFile, blini.SketchFileSuffix) {
+		*oFile += blini.SketchFileSuffix
+	}
+	fmt.Println("Saving to:", *oFile)
+
+	f, err := aio.Create(*oFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The output segment takes its settings from the first input segment.
+	var sw *blini.SketchWriter
+	var werr error
+	onHeader := func(h blini.SketchFileHeader) {
+		if sw == nil && werr == nil {
+			sw, werr = blini.NewSketchWriter(f, h.K, h.Scale, h.Counts)
+		}
+	}
+	fmt.Println("Merging sketches")
+	seq := withProgress(func(yield func(blini.Sketch, error) bool) {
+		for _, file := range files {
+			for e, err := range blini.ReadSketchesFunc(file, onHeader) {
+				if !yield(e, err) || err != nil {
+					return
+				}
+			}
+		}
+	})
+	for e, err := range seq {
+		if err == nil {
+			err = werr
+		}
+		if err == nil {
+			err = sw.Write(e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if werr != nil {
+		return werr
+	}
+	if sw == nil {
+		return fmt.Errorf("no sketch file segments in the input")
+	}
+	return sw.Close()
+}
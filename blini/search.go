@@ -3,16 +3,19 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
+	"slices"
 	"strings"
 
-	"github.com/fluhus/biostuff/formats/fasta"
-	"github.com/fluhus/biostuff/mash/v2"
-	"github.com/fluhus/blini/sketching"
-	"github.com/fluhus/gostuff/aio"
+	"github.com/fluhus/blini"
 	"github.com/fluhus/gostuff/ptimer"
+	"github.com/fluhus/gostuff/sets"
+	"github.com/fluhus/gostuff/snm"
 )
 
 // Main function for search operation.
@@ -20,82 +23,265 @@ func mainSearch() error {
 	fmt.Println("----------------")
 	fmt.Println("SEARCH OPERATION")
 	fmt.Println("----------------")
-	var sk sketches
-	var err error
-	if strings.HasSuffix(*rFile, indexSuffix) {
-		fmt.Println("Reading prepared sketches")
-		sk, err = collectSketches(readSketches(*rFile))
-	} else {
-		fmt.Println("Sketching reference sequences")
-		sk, err = collectSketches(sketchFile(*rFile))
+	top := *topN
+	if *best {
+		if top != 0 {
+			return fmt.Errorf("only one of -top and -best may be set")
+		}
+		top = 1
 	}
+	cols, err := parseColumns(*columns)
+	if err != nil {
+		return err
+	}
+
+	ref, err := loadReference(*rFile)
 	if err != nil {
 		return err
 	}
-	fmt.Println("Scale:", sk.scale)
+	defer ref.Close()
+	sk := ref.Sketches
+	if *abundance && sk.Counts == nil {
+		return fmt.Errorf("reference sketches have no abundances, " +
+			"sketch them with -a")
+	}
+	fmt.Println("Scale:", sk.Scale)
+	fmt.Println("K:", sk.K)
 	fmt.Println("Min sim:", *minSim)
+	if top > 0 {
+		fmt.Println("Top:", top)
+	}
+	fmt.Println("Threads:", *nThreads)
 
-	fmt.Println("Indexing")
-	pt := ptimer.New()
-	idx := sketching.NewIndex(sk.scale * idxScale)
-	for i, s := range sk.skch {
-		idx.Add(s, i)
-		pt.Inc()
+	qopts, err := sketchOptions()
+	if err != nil {
+		return err
 	}
-	pt.Done()
+	qopts.K, qopts.Scale = sk.K, sk.Scale
 
 	fmt.Println("Searching")
-	var fout io.Writer
-	if *oFile != "" {
-		f, err := aio.Create(*oFile)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		fout = f
-	} else {
-		fout = io.Discard
+	fout, err := createOutput(*oFile)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	out, err := newRowWriter(fout, *outFormat,
+		snm.SliceToSlice(cols, func(c searchColumn) string {
+			return c.name
+		}))
+	if err != nil {
+		return err
 	}
-	out := csv.NewWriter(fout)
-	defer out.Flush()
-
-	out.Write([]string{"similarity", "query", "reference"})
 
 	var matches int
-	pt = ptimer.NewFunc(func(i int) string {
+	pt := ptimer.NewFunc(func(i int) string {
 		return fmt.Sprintf("%d (%d matches)", i, matches)
 	})
-	for fa, err := range fasta.File(*qFile) {
+	opts := blini.SearchOptions{
+		SimilarityOptions: simOptions(),
+		MinSimilarity:     *minSim,
+		Threads:           *nThreads,
+		Top:               top,
+	}
+	results := ref.Search(context.Background(),
+		blini.SketchInput(*qFile, qopts), opts)
+	for r, err := range results {
 		if err != nil {
 			return err
 		}
-		s := sketching.Sketch(fa.Sequence, kmerLen, sk.scale)
-		found := false
-		for _, f := range idx.Search(s) {
-			var sim float64
-			if useMyDist {
-				sim = 1 - myDist(s, sk.skch[f], len(fa.Sequence), sk.lens[f])
-			} else {
-				sim = 1 - mash.FromJaccard(jaccard(s, sk.skch[f]), kmerLen)
+		matches += len(r.Hits)
+		for _, row := range searchRows(r, ref, cols) {
+			if err := out.write(row); err != nil {
+				return err
 			}
-			if sim >= *minSim {
-				matches++
-				output := []string{
-					fmt.Sprintf("%.0f%%", sim*100),
-					string(fa.Name),
-					sk.names[f],
-				}
-				out.Write(output)
-				found = true
-			}
-		}
-		if !found && *unmatched { // Report unmatched query.
-			output := []string{"0%", string(fa.Name), unmatchedRef}
-			out.Write(output)
 		}
 		pt.Inc()
 	}
 	pt.Done()
 
-	return nil
+	return out.flush()
+}
+
+// Details of a query-reference pair, for output.
+type hitInfo struct {
+	q, r   blini.Sketch // Query and reference.
+	sim    float64      // Similarity.
+	shared int          // Number of shared hashes.
+}
+
+// A search output column.
+type searchColumn struct {
+	name  string              // Column name, as given by the user.
+	value func(h hitInfo) any // Returns the column's value.
+}
+
+// Available search output columns.
+var searchColumns = []searchColumn{
+	{"similarity", func(h hitInfo) any {
+		return fmt.Sprintf("%.0f%%", h.sim*100)
+	}},
+	{"query", func(h hitInfo) any { return h.q.Name }},
+	{"reference", func(h hitInfo) any { return h.r.Name }},
+	{"sim", func(h hitInfo) any { return h.sim }},
+	{"jaccard", func(h hitInfo) any {
+		return ratio(h.shared, len(h.q.Hashes)+len(h.r.Hashes)-h.shared)
+	}},
+	{"qcont", func(h hitInfo) any {
+		return ratio(h.shared, len(h.q.Hashes))
+	}},
+	{"rcont", func(h hitInfo) any {
+		return ratio(h.shared, len(h.r.Hashes))
+	}},
+	{"shared", func(h hitInfo) any { return h.shared }},
+	{"total", func(h hitInfo) any {
+		return len(h.q.Hashes) + len(h.r.Hashes) - h.shared
+	}},
+	{"qlen", func(h hitInfo) any { return h.q.Length }},
+	{"rlen", func(h hitInfo) any { return h.r.Length }},
+	{"qhashes", func(h hitInfo) any { return len(h.q.Hashes) }},
+	{"rhashes", func(h hitInfo) any { return len(h.r.Hashes) }},
+}
+
+// Returns a/b, or 0 if b is 0.
+func ratio(a, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+// Returns the output columns with the given comma-separated names.
+func parseColumns(names string) ([]searchColumn, error) {
+	var result []searchColumn
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		i := slices.IndexFunc(searchColumns, func(c searchColumn) bool {
+			return c.name == name
+		})
+		if i == -1 {
+			return nil, fmt.Errorf("unknown column: %q", name)
+		}
+		result = append(result, searchColumns[i])
+	}
+	return result, nil
+}
+
+// Returns the names of the available output columns.
+func columnNames() string {
+	return strings.Join(snm.SliceToSlice(searchColumns,
+		func(c searchColumn) string { return c.name }), ",")
+}
+
+// Returns the output rows of a single query's result.
+func searchRows(r blini.SearchResult, ref *blini.Reference,
+	cols []searchColumn) [][]any {
+	var rows [][]any
+	for _, h := range r.Hits {
+		rs := ref.Sketches.At(h.Reference)
+		rows = append(rows, columnValues(cols, hitInfo{
+			r.Query, rs, h.Similarity,
+			sets.SortedIntersectionLen(r.Query.Hashes, rs.Hashes),
+		}))
+	}
+	if len(rows) == 0 && *unmatched { // Report unmatched query.
+		rows = append(rows, columnValues(cols, hitInfo{
+			q: r.Query, r: blini.Sketch{Name: unmatchedRef},
+		}))
+	}
+	return rows
+}
+
+// Returns the values of the given columns.
+func columnValues(cols []searchColumn, h hitInfo) []any {
+	return snm.SliceToSlice(cols, func(c searchColumn) any {
+		return c.value(h)
+	})
+}
+
+// Output formats.
+const (
+	formatCSV   = "csv"
+	formatTSV   = "tsv"
+	formatJSONL = "jsonl"
+	formatJSON  = "json"
+	formatClstr = "clstr" // CD-HIT cluster file.
+)
+
+// Writes search output rows in one of the output formats.
+type rowWriter struct {
+	cols  []string    // Column names.
+	csv   *csv.Writer // For CSV and TSV.
+	json  *bufio.Writer
+	jsonb []byte // Buffer for JSON lines.
+}
+
+// Returns a row writer in the given format.
+// CSV and TSV outputs start with a header row.
+func newRowWriter(w io.Writer, format string, cols []string,
+) (*rowWriter, error) {
+	rw := &rowWriter{cols: cols}
+	switch format {
+	case formatCSV, formatTSV:
+		rw.csv = csv.NewWriter(w)
+		if format == formatTSV {
+			rw.csv.Comma = '\t'
+		}
+		if err := rw.csv.Write(cols); err != nil {
+			return nil, err
+		}
+	case formatJSONL:
+		rw.json = bufio.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unsupported output format: %q", format)
+	}
+	return rw, nil
+}
+
+// Writes a row.
+func (w *rowWriter) write(row []any) error {
+	if w.csv != nil {
+		return w.csv.Write(snm.SliceToSlice(row, formatValue))
+	}
+	// JSON object with fields in column order.
+	b := append(w.jsonb[:0], '{')
+	for i, v := range row {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		var err error
+		if b, err = appendJSON(b, w.cols[i]); err != nil {
+			return err
+		}
+		b = append(b, ':')
+		if b, err = appendJSON(b, v); err != nil {
+			return err
+		}
+	}
+	b = append(b, '}', '\n')
+	w.jsonb = b
+	_, err := w.json.Write(b)
+	return err
+}
+
+// Flushes buffered output.
+func (w *rowWriter) flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		return w.csv.Error()
+	}
+	return w.json.Flush()
+}
+
+// Formats a value for CSV and TSV output.
+func formatValue(v any) string {
+	if f, ok := v.(float64); ok {
+		return fmt.Sprintf("%.6f", f)
+	}
+	return fmt.Sprint(v)
+}
+
+// Appends the JSON encoding of a value.
+func appendJSON(b []byte, v any) ([]byte, error) {
+	j, err := json.Marshal(v)
+	return append(b, j...), err
 }
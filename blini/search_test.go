@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/fluhus/blini"
+	"github.com/fluhus/gostuff/snm"
+)
+
+func TestSearchRows(t *testing.T) {
+	ref := blini.NewReference(&blini.Sketches{
+		Hashes:  [][]uint64{{1, 2, 3, 4}},
+		Lengths: []int{400},
+		Names:   []string{"r"},
+		Records: make([][]int, 1),
+		Scale:   1,
+		K:       21,
+	})
+	q := blini.Sketch{Name: "q", Hashes: []uint64{2, 3, 4, 5, 6},
+		Length: 500, Scale: 1, K: 21}
+	cols, err := parseColumns(columnNames())
+	if err != nil {
+		t.Fatalf("parseColumns(%q) failed: %v", columnNames(), err)
+	}
+	hits := []blini.Hit{{Reference: 0, Name: "r", Similarity: 0.987654}}
+	rows := searchRows(blini.SearchResult{Query: q, Hits: hits}, ref, cols)
+	if len(rows) != 1 {
+		t.Fatalf("searchRows(...) returned %d rows, want 1", len(rows))
+	}
+	got := snm.SliceToSlice(rows[0], formatValue)
+	want := []string{"99%", "q", "r", "0.987654", "0.500000", "0.600000",
+		"0.750000", "3", "6", "500", "400", "5", "4"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("searchRows(...)=%q, want %q", got, want)
+	}
+
+	if _, err := parseColumns("query,foo"); err == nil {
+		t.Fatalf("parseColumns(\"query,foo\") succeeded, want error")
+	}
+}
+
+func TestRowWriter(t *testing.T) {
+	cols := []string{"query", "reference", "sim", "shared"}
+	rows := [][]any{{"q1", "r,1", 0.5, 3}, {"q2", "r2", 1.0, 10}}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{formatCSV, "query,reference,sim,shared\n" +
+			"q1,\"r,1\",0.500000,3\nq2,r2,1.000000,10\n"},
+		{formatTSV, "query\treference\tsim\tshared\n" +
+			"q1\tr,1\t0.500000\t3\nq2\tr2\t1.000000\t10\n"},
+		{formatJSONL,
+			`{"query":"q1","reference":"r,1","sim":0.5,"shared":3}` + "\n" +
+				`{"query":"q2","reference":"r2","sim":1,"shared":10}` + "\n"},
+	}
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		w, err := newRowWriter(buf, test.format, cols)
+		if err != nil {
+			t.Fatalf("newRowWriter(%q) failed: %v", test.format, err)
+		}
+		for _, row := range rows {
+			if err := w.write(row); err != nil {
+				t.Fatalf("write(%v) failed: %v", row, err)
+			}
+		}
+		if err := w.flush(); err != nil {
+			t.Fatalf("flush() failed: %v", err)
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("%s output:\n%s\nwant:\n%s", test.format, got, test.want)
+		}
+	}
+}
@@ -5,11 +5,11 @@ package main
 import (
 	"fmt"
 	"io"
+	"os"
 	"strings"
 
+	"github.com/fluhus/blini"
 	"github.com/fluhus/gostuff/aio"
-	"github.com/fluhus/gostuff/bnry"
-	"github.com/fluhus/gostuff/ptimer"
 )
 
 // Main function for sketching operation.
@@ -18,39 +18,99 @@ func mainSketch() error {
 	fmt.Println("SKETCH OPERATION")
 	fmt.Println("----------------")
 	fmt.Println("Scale:", *scale)
+	fmt.Println("K:", *kmerLen)
+	fmt.Println("Threads:", *nThreads)
 
-	if *unmatched {
-		return fmt.Errorf("flag -u is for search, not for sketching")
+	if err := checkSequenceInput(*inFile); err != nil {
+		return err
+	}
+	opts, err := sketchOptions()
+	if err != nil {
+		return err
 	}
 
-	var out io.Writer
 	if *oFile == "" {
 		fmt.Println("No output")
-		out = io.Discard
 	} else {
-		if !strings.HasSuffix(*oFile, indexSuffix) {
-			*oFile += indexSuffix
+		if !strings.HasSuffix(*oFile, blini.SketchFileSuffix) {
+			*oFile += blini.SketchFileSuffix
 		}
 		fmt.Println("Saving to:", *oFile)
-		f, err := aio.Create(*oFile)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		out = f
 	}
 
 	fmt.Println("Sketching sequences")
-	pt := ptimer.New()
-	for e, err := range sketchFile(*rFile) {
+	input := withProgress(blini.SketchInput(*inFile, opts))
+	if *oFile == "" {
+		for _, err := range input {
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	f, err := aio.Create(*oFile)
+	if err != nil {
+		return err
+	}
+	sw, err := blini.NewSketchWriter(f, opts.K, opts.Scale, opts.Abundance)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// Sketches are kept in memory only for the in-memory index.
+	sk := &blini.Sketches{Scale: opts.Scale, K: opts.K}
+	for e, err := range input {
+		if err == nil {
+			err = sw.Write(e)
+		}
+		if err == nil && *writeIdx {
+			err = sk.Add(e)
+		}
 		if err != nil {
+			f.Close()
 			return err
 		}
-		if err := bnry.Write(out, e.s, e.ln, e.name, e.scale); err != nil {
+	}
+	if err := sw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	err = writeIndexFile(*writeIdx, *oFile+blini.IndexFileSuffix,
+		func(w io.Writer) error {
+			return blini.NewReference(sk).WriteIndex(w)
+		})
+	if err != nil {
+		return err
+	}
+	return writeIndexFile(*writeMapped, *oFile+blini.MappedIndexFileSuffix,
+		func(w io.Writer) error {
+			return blini.WriteMappedIndex(w, *oFile)
+		})
+}
+
+// Writes an index file using the given function if write is true.
+// Otherwise removes the file, since an index of a previous sketch file
+// would not match the new one.
+func writeIndexFile(write bool, file string, f func(io.Writer) error,
+) error {
+	if !write {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
 			return err
 		}
-		pt.Inc()
+		return nil
+	}
+	fmt.Println("Writing index to:", file)
+	fout, err := aio.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := f(fout); err != nil {
+		fout.Close()
+		return err
 	}
-	pt.Done()
-	return nil
+	return fout.Close()
 }
@@ -0,0 +1,219 @@
+// Tree building logic.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/fluhus/biostuff/formats/newick"
+	"github.com/fluhus/blini"
+	"github.com/fluhus/gostuff/ppln"
+	"github.com/fluhus/gostuff/ptimer"
+)
+
+// Tree building methods.
+const (
+	treeNJ    = "nj"    // Neighbor joining.
+	treeUPGMA = "upgma" // Unweighted pair group method with arithmetic mean.
+)
+
+// Main function for tree operation.
+func mainTree() error {
+	fmt.Println("--------------")
+	fmt.Println("TREE OPERATION")
+	fmt.Println("--------------")
+	fmt.Println("Method:", *treeMethod)
+	fmt.Println("Threads:", *nThreads)
+
+	ref, err := loadReference(*inFile)
+	if err != nil {
+		return err
+	}
+	defer ref.Close()
+	sk := ref.Sketches
+	if sk.Len() == 0 {
+		return fmt.Errorf("no input sequences")
+	}
+	fmt.Println("Scale:", sk.Scale)
+	fmt.Println("K:", sk.K)
+
+	fmt.Println("Calculating distances")
+	d, err := distMatrix(ref)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Building tree")
+	var tree *newick.Node
+	switch *treeMethod {
+	case treeNJ:
+		tree = neighborJoining(d, sk.Names)
+	case treeUPGMA:
+		tree = upgma(d, sk.Names)
+	default:
+		return fmt.Errorf("unsupported tree method: %q", *treeMethod)
+	}
+
+	fout, err := createOutput(*oFile)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	if err := tree.Write(fout); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(fout)
+	return err
+}
+
+// Returns a symmetric matrix of distances between all pairs of sketches.
+// Pairs that are not found by the index get a distance of 1.
+func distMatrix(ref *blini.Reference) ([][]float64, error) {
+	n := ref.Sketches.Len()
+	d := make([][]float64, n)
+	i := 0 // Current row.
+	pt := ptimer.New()
+	err := ppln.Serial(*nThreads, ppln.RangeInput(0, n),
+		func(i, _, _ int) (map[int]float64, error) {
+			_, dists, err := candDists(i, ref)
+			return dists, err
+		}, func(dists map[int]float64) error {
+			d[i] = make([]float64, n)
+			for j := range d[i] {
+				if j == i {
+					continue
+				}
+				if dd, ok := dists[j]; ok {
+					d[i][j] = dd
+				} else {
+					d[i][j] = 1
+				}
+			}
+			i++
+			pt.Inc()
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	pt.Done()
+	return d, nil
+}
+
+// Returns a neighbor-joining tree of the given distance matrix.
+// The matrix is modified.
+func neighborJoining(d [][]float64, names []string) *newick.Node {
+	nodes := make([]*newick.Node, len(names))
+	for i, name := range names {
+		nodes[i] = &newick.Node{Name: name}
+	}
+	active := make([]int, len(names)) // Row numbers of the active nodes.
+	for i := range active {
+		active[i] = i
+	}
+
+	for len(active) > 3 {
+		n := len(active)
+		r := make([]float64, n) // Sums of distances.
+		for a, i := range active {
+			for _, j := range active {
+				r[a] += d[i][j]
+			}
+		}
+
+		// Find the pair that minimizes Q.
+		ba, bb := 0, 1
+		bq := 0.0
+		for a := range n {
+			for b := a + 1; b < n; b++ {
+				q := float64(n-2)*d[active[a]][active[b]] - r[a] - r[b]
+				if (a == 0 && b == 1) || q < bq {
+					ba, bb, bq = a, b, q
+				}
+			}
+		}
+
+		// Join them into a new node, stored in ba's row.
+		i, j := active[ba], active[bb]
+		di := d[i][j]/2 + (r[ba]-r[bb])/float64(2*(n-2))
+		di = min(max(di, 0), d[i][j])
+		nodes[i].Distance = di
+		nodes[j].Distance = d[i][j] - di
+		for _, k := range active {
+			if k == i || k == j {
+				continue
+			}
+			dk := (d[i][k] + d[j][k] - d[i][j]) / 2
+			d[i][k], d[k][i] = dk, dk
+		}
+		nodes[i] = &newick.Node{Children: []*newick.Node{nodes[i], nodes[j]}}
+		nodes[j] = nil
+		active = append(active[:bb], active[bb+1:]...)
+	}
+
+	// Join the remaining nodes at the root.
+	switch len(active) {
+	case 1:
+		return nodes[active[0]]
+	case 2:
+		i, j := active[0], active[1]
+		nodes[i].Distance = d[i][j] / 2
+		nodes[j].Distance = d[i][j] / 2
+		return &newick.Node{Children: []*newick.Node{nodes[i], nodes[j]}}
+	default:
+		i, j, k := active[0], active[1], active[2]
+		nodes[i].Distance = max((d[i][j]+d[i][k]-d[j][k])/2, 0)
+		nodes[j].Distance = max((d[i][j]+d[j][k]-d[i][k])/2, 0)
+		nodes[k].Distance = max((d[i][k]+d[j][k]-d[i][j])/2, 0)
+		return &newick.Node{
+			Children: []*newick.Node{nodes[i], nodes[j], nodes[k]}}
+	}
+}
+
+// Returns a UPGMA tree of the given distance matrix.
+// The matrix is modified.
+func upgma(d [][]float64, names []string) *newick.Node {
+	nodes := make([]*newick.Node, len(names))
+	for i, name := range names {
+		nodes[i] = &newick.Node{Name: name}
+	}
+	sizes := make([]int, len(names))       // Number of leaves under nodes.
+	heights := make([]float64, len(names)) // Heights of nodes.
+	active := make([]int, len(names))      // Row numbers of active nodes.
+	for i := range active {
+		sizes[i] = 1
+		active[i] = i
+	}
+
+	for len(active) > 1 {
+		// Find the closest pair.
+		ba, bb := 0, 1
+		for a := range active {
+			for b := a + 1; b < len(active); b++ {
+				if d[active[a]][active[b]] < d[active[ba]][active[bb]] {
+					ba, bb = a, b
+				}
+			}
+		}
+
+		// Join them into a new node, stored in ba's row.
+		i, j := active[ba], active[bb]
+		h := d[i][j] / 2
+		nodes[i].Distance = max(h-heights[i], 0)
+		nodes[j].Distance = max(h-heights[j], 0)
+		for _, k := range active {
+			if k == i || k == j {
+				continue
+			}
+			dk := (float64(sizes[i])*d[i][k] + float64(sizes[j])*d[j][k]) /
+				float64(sizes[i]+sizes[j])
+			d[i][k], d[k][i] = dk, dk
+		}
+		nodes[i] = &newick.Node{Children: []*newick.Node{nodes[i], nodes[j]}}
+		nodes[j] = nil
+		sizes[i] += sizes[j]
+		heights[i] = h
+		active = append(active[:bb], active[bb+1:]...)
+	}
+	return nodes[active[0]]
+}
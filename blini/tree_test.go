@@ -0,0 +1,63 @@
+package main
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/fluhus/biostuff/formats/newick"
+)
+
+func TestNeighborJoining(t *testing.T) {
+	// Example from Wikipedia.
+	d := [][]float64{
+		{0, 5, 9, 9, 8},
+		{5, 0, 10, 10, 9},
+		{9, 10, 0, 8, 7},
+		{9, 10, 8, 0, 3},
+		{8, 9, 7, 3, 0},
+	}
+	names := []string{"a", "b", "c", "d", "e"}
+	tree := neighborJoining(d, names)
+
+	wantLeaves := map[string]float64{"a": 2, "b": 3, "c": 4, "d": 2, "e": 1}
+	if got := leafDistances(tree); !maps.Equal(got, wantLeaves) {
+		t.Errorf("neighborJoining(...) leaves=%v, want %v", got, wantLeaves)
+	}
+	if got, want := treeLength(tree), 17.0; got != want {
+		t.Errorf("neighborJoining(...) length=%v, want %v", got, want)
+	}
+}
+
+func TestUPGMA(t *testing.T) {
+	d := [][]float64{
+		{0, 2, 4},
+		{2, 0, 4},
+		{4, 4, 0},
+	}
+	names := []string{"a", "b", "c"}
+	got, _ := upgma(d, names).MarshalText()
+	want := "((a:1,b:1):1,c:2);"
+	if string(got) != want {
+		t.Errorf("upgma(...)=%q, want %q", got, want)
+	}
+}
+
+// Returns the branch lengths of the leaves of a tree.
+func leafDistances(tree *newick.Node) map[string]float64 {
+	m := map[string]float64{}
+	for n := range tree.PreOrder() {
+		if len(n.Children) == 0 {
+			m[n.Name] = n.Distance
+		}
+	}
+	return m
+}
+
+// Returns the sum of branch lengths in a tree.
+func treeLength(tree *newick.Node) float64 {
+	sum := 0.0
+	for n := range tree.PreOrder() {
+		sum += n.Distance
+	}
+	return sum
+}
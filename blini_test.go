@@ -0,0 +1,62 @@
+package blini
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSketchesAdd(t *testing.T) {
+	sk := &Sketches{}
+	a := Sketch{Name: "a", Hashes: []uint64{1, 2}, Counts: []uint32{3, 4},
+		Length: 10, Scale: 5, K: 21}
+	if err := sk.Add(a); err != nil {
+		t.Fatalf("Add(%v) failed: %v", a, err)
+	}
+	if got := sk.At(0); !reflect.DeepEqual(got, a) {
+		t.Fatalf("At(0)=%v, want %v", got, a)
+	}
+
+	bad := []Sketch{
+		{Name: "b", Hashes: []uint64{1}, Scale: 5, K: 21},
+		{Name: "b", Hashes: []uint64{1}, Counts: []uint32{1}, Scale: 6, K: 21},
+		{Name: "b", Hashes: []uint64{1}, Counts: []uint32{1}, Scale: 5, K: 11},
+	}
+	for _, b := range bad {
+		if err := sk.Add(b); err == nil {
+			t.Errorf("Add(%v) succeeded, want error", b)
+		}
+	}
+	if sk.Len() != 1 {
+		t.Fatalf("Len()=%d, want 1", sk.Len())
+	}
+}
+
+func TestSketchesAt_noRecords(t *testing.T) {
+	sk := &Sketches{Hashes: [][]uint64{{1, 2}}, Lengths: []int{10},
+		Names: []string{"a"}, Scale: 5, K: 21}
+	want := Sketch{Name: "a", Hashes: []uint64{1, 2}, Length: 10,
+		Scale: 5, K: 21}
+	if got := sk.At(0); !reflect.DeepEqual(got, want) {
+		t.Fatalf("At(0)=%v, want %v", got, want)
+	}
+}
+
+func TestSimilarity_errors(t *testing.T) {
+	a := Sketch{Hashes: []uint64{1, 2}, Counts: []uint32{1, 1},
+		Scale: 1, K: 21}
+	b := Sketch{Hashes: []uint64{1, 2}, Scale: 1, K: 21}
+	abund := SimilarityOptions{Abundance: true}
+	if _, err := Similarity(a, a, abund); err != nil {
+		t.Errorf("Similarity(a, a) failed: %v", err)
+	}
+	if _, err := Similarity(a, b, abund); err == nil {
+		t.Errorf("Similarity(a, b, abundance) succeeded, want error")
+	}
+	if _, err := Similarity(a, b, SimilarityOptions{}); err != nil {
+		t.Errorf("Similarity(a, b) failed: %v", err)
+	}
+	b.K = 11
+	if _, err := Similarity(a, b, SimilarityOptions{}); err == nil {
+		t.Errorf("Similarity(a, b) with different k succeeded, want error")
+	}
+}
@@ -5,7 +5,7 @@ set -e
 EXE=blini
 VERSION=v0.4.0
 OUTDIR=../release
-FLAGS="-ldflags=-s -X main.version=$VERSION"
+FLAGS="-ldflags=-s -X github.com/fluhus/blini.Version=$VERSION"
 
 rm -fr $OUTDIR
 mkdir $OUTDIR
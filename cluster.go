@@ -0,0 +1,518 @@
+// Clustering logic.
+
+package blini
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/fluhus/blini/sketching"
+	"github.com/fluhus/gostuff/snm"
+)
+
+// ClusterMode is a clustering algorithm.
+type ClusterMode int
+
+const (
+	// Greedy centroid-based clustering, see Cluster.
+	Greedy ClusterMode = iota
+
+	// Single-linkage clustering: connected components of the graph of
+	// pairs with at least the minimal similarity.
+	SingleLinkage
+)
+
+// RepSelection is a way of choosing cluster representatives.
+type RepSelection int
+
+const (
+	Longest    RepSelection = iota // Prefer longer sketches.
+	Shortest                       // Prefer shorter sketches.
+	InputOrder                     // Prefer lower serial numbers.
+
+	// The member with the highest mean similarity to the other members.
+	// Takes time quadratic in cluster sizes.
+	Centroid
+
+	// Prefer lower priority values, then longer sketches.
+	Priority
+)
+
+// ClusterOptions control clustering.
+type ClusterOptions struct {
+	SimilarityOptions
+
+	Mode ClusterMode  // Clustering algorithm.
+	Rep  RepSelection // Choice of representatives.
+
+	// Priority of each sketch, for Priority representative selection.
+	// Lower values are preferred.
+	Priorities []int
+
+	// Minimal similarity to a representative, or between linked pairs
+	// in single-linkage mode.
+	MinSimilarity float64
+
+	// Move each member to the cluster of its most similar representative,
+	// after all representatives are chosen.
+	Reassign bool
+}
+
+// Cluster is a group of similar sketches.
+type Cluster struct {
+	// Serial numbers of the member sketches.
+	// The first member is the representative, and the rest are sorted.
+	Members []int
+
+	// Similarities of the members to the representative,
+	// parallel to Members.
+	Similarities []float64
+}
+
+// Cluster greedily clusters (dereplicates) the sketches.
+// Sketches are visited from longest to shortest (or in the order given
+// by Rep); each sketch that is not yet clustered becomes a representative,
+// and collects all unclustered sketches whose similarity to it is at least
+// the minimum.
+// With Reassign, members then move to their most similar representative.
+// With Centroid, each cluster's centroid then becomes its representative.
+// Other modes are selected with Mode.
+// Clusters are ordered by their representatives' serial numbers.
+func (sk *Sketches) Cluster(ctx context.Context, opts ClusterOptions,
+) ([]Cluster, error) {
+	if err := opts.check(sk); err != nil {
+		return nil, err
+	}
+	return sk.clusterRest(ctx, make([]bool, sk.Len()), opts)
+}
+
+// Clusters the sketches that are not done using the selected mode,
+// and marks them as done.
+func (sk *Sketches) clusterRest(ctx context.Context, done []bool,
+	opts ClusterOptions) ([]Cluster, error) {
+	if !slices.Contains(done, false) {
+		return nil, nil
+	}
+	return sk.clusterIndexed(ctx, sk.restIndex(done), done, opts)
+}
+
+// Returns an index of the sketches that are not done, without hashes
+// that only one sketch has.
+func (sk *Sketches) restIndex(done []bool) *sketching.Index {
+	idx := sketching.NewIndex(sk.Scale * idxScale)
+	for i, s := range sk.Hashes {
+		if !done[i] {
+			idx.Add(s, i)
+		}
+	}
+	idx.Clean()
+	return idx
+}
+
+// Clusters the sketches that are not done using the selected mode,
+// and marks them as done. The index should have all these sketches,
+// and may have others.
+func (sk *Sketches) clusterIndexed(ctx context.Context,
+	idx *sketching.Index, done []bool, opts ClusterOptions,
+) ([]Cluster, error) {
+	if opts.Reassign && opts.Mode != Greedy {
+		return nil, fmt.Errorf("reassignment requires greedy clustering")
+	}
+	var clusters []Cluster
+	var err error
+	switch opts.Mode {
+	case Greedy:
+		clusters, err = sk.greedyClusters(ctx, idx, done, opts)
+	case SingleLinkage:
+		clusters, err = sk.linkageClusters(ctx, idx, done, opts)
+	default:
+		return nil, fmt.Errorf("unsupported cluster mode: %d", opts.Mode)
+	}
+	if err != nil || opts.Rep != Centroid {
+		return clusters, err
+	}
+
+	for i, c := range clusters {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		clusters[i] = sk.centroid(c, opts.SimilarityOptions)
+	}
+	slices.SortFunc(clusters, func(a, b Cluster) int {
+		return cmp.Compare(a.Members[0], b.Members[0])
+	})
+	return clusters, nil
+}
+
+// Returns the sketches' serial numbers in order of preference
+// as representatives.
+func (sk *Sketches) repOrder(opts ClusterOptions) ([]int, error) {
+	longest := func(a, b int) int {
+		return cmp.Compare(sk.Lengths[b], sk.Lengths[a])
+	}
+	perm := snm.Slice(sk.Len(), func(i int) int { return i })
+	switch opts.Rep {
+	case Longest, Centroid:
+		slices.SortStableFunc(perm, longest)
+	case Shortest:
+		slices.SortStableFunc(perm, func(a, b int) int {
+			return cmp.Compare(sk.Lengths[a], sk.Lengths[b])
+		})
+	case InputOrder:
+	case Priority:
+		if len(opts.Priorities) != sk.Len() {
+			return nil, fmt.Errorf("got %d priorities for %d sketches",
+				len(opts.Priorities), sk.Len())
+		}
+		slices.SortStableFunc(perm, func(a, b int) int {
+			return cmp.Or(cmp.Compare(opts.Priorities[a], opts.Priorities[b]),
+				longest(a, b))
+		})
+	default:
+		return nil, fmt.Errorf("unsupported representative selection: %d",
+			opts.Rep)
+	}
+	return perm, nil
+}
+
+// Returns the cluster with its centroid as the representative:
+// the member with the highest mean similarity to the other members.
+// Ties are broken in favor of the current representative, then by
+// member order.
+func (sk *Sketches) centroid(c Cluster, opts SimilarityOptions) Cluster {
+	if len(c.Members) < 3 { // All members are equally central.
+		return c
+	}
+	best, bestSum := 0, 0.0
+	for i, m := range c.Members {
+		s := sk.At(m)
+		sum := 0.0
+		for j, o := range c.Members {
+			if j != i {
+				sum += similarity(sk.At(o), s, opts)
+			}
+		}
+		if i == 0 || sum > bestSum {
+			best, bestSum = i, sum
+		}
+	}
+	if best == 0 {
+		return c
+	}
+
+	members := slices.Clone(c.Members)
+	members[0], members[best] = members[best], members[0]
+	result := Cluster{Members: members,
+		Similarities: make([]float64, len(members))}
+	result.Similarities[0] = 1
+	rep := sk.At(members[0])
+	for i, m := range members[1:] {
+		result.Similarities[i+1] = similarity(sk.At(m), rep, opts)
+	}
+	result.sortMembers()
+	return result
+}
+
+// Greedily clusters the sketches that are not done, and marks them
+// as done.
+func (sk *Sketches) greedyClusters(ctx context.Context,
+	idx *sketching.Index, done []bool, opts ClusterOptions,
+) ([]Cluster, error) {
+	n := 0 // Sketches to cluster.
+	for _, d := range done {
+		if !d {
+			n++
+		}
+	}
+
+	perm, err := sk.repOrder(opts)
+	if err != nil {
+		return nil, err
+	}
+	var clusters []Cluster
+	for _, i := range perm {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if done[i] {
+			continue
+		}
+		done[i] = true
+		s := sk.At(i)
+
+		// Create cluster.
+		c := Cluster{Members: []int{i}, Similarities: []float64{1}}
+		for _, f := range idx.Search(s.Hashes) {
+			if done[f] {
+				continue
+			}
+			sim := similarity(sk.At(f), s, opts.SimilarityOptions)
+			if sim < opts.MinSimilarity {
+				continue
+			}
+			c.Members = append(c.Members, f)
+			c.Similarities = append(c.Similarities, sim)
+			done[f] = true
+		}
+		clusters = append(clusters, c)
+	}
+
+	if opts.Reassign {
+		if clusters, err = sk.reassign(ctx, clusters, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	// Sanity check.
+	nn := 0
+	for _, c := range clusters {
+		nn += len(c.Members)
+	}
+	if nn != n {
+		return nil, fmt.Errorf("clustered %d sketches out of %d", nn, n)
+	}
+
+	// Sort clusters for deterministic output.
+	for _, c := range clusters {
+		c.sortMembers()
+	}
+	slices.SortFunc(clusters, func(a, b Cluster) int {
+		return cmp.Compare(a.Members[0], b.Members[0])
+	})
+	return clusters, nil
+}
+
+// ClusterLevels clusters the sketches at each of the given minimal
+// similarities, which should be in descending order.
+// The first level clusters all the sketches, and each next level clusters
+// the representatives of the previous level, so that each cluster is
+// a union of clusters of the previous level.
+// The sketches are indexed once for all levels.
+// The clusters of each level have all the sketches as members,
+// with their similarities to their representatives.
+func (sk *Sketches) ClusterLevels(ctx context.Context, minSims []float64,
+	opts ClusterOptions) ([][]Cluster, error) {
+	if err := opts.check(sk); err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(minSims); i++ {
+		if minSims[i] >= minSims[i-1] {
+			return nil, fmt.Errorf("similarities are not in descending "+
+				"order: %v", minSims)
+		}
+	}
+	if sk.Len() == 0 {
+		return make([][]Cluster, len(minSims)), nil
+	}
+
+	idx := sk.restIndex(make([]bool, sk.Len()))
+	var levels [][]Cluster
+	for _, m := range minSims {
+		done := make([]bool, sk.Len())
+		var prev map[int]Cluster // Previous level, by representative.
+		if len(levels) > 0 {
+			prev = map[int]Cluster{}
+			for i := range done {
+				done[i] = true
+			}
+			for _, c := range levels[len(levels)-1] {
+				prev[c.Members[0]] = c
+				done[c.Members[0]] = false
+			}
+		}
+		opts.MinSimilarity = m
+		clusters, err := sk.clusterIndexed(ctx, idx, done, opts)
+		if err != nil {
+			return nil, err
+		}
+		if prev != nil {
+			for i, c := range clusters {
+				clusters[i] = sk.mergeClusters(c, prev, opts.SimilarityOptions)
+			}
+		}
+		levels = append(levels, clusters)
+	}
+	return levels, nil
+}
+
+// Returns a cluster of the members of the given previous-level clusters,
+// whose representatives are c's members.
+func (sk *Sketches) mergeClusters(c Cluster, prev map[int]Cluster,
+	opts SimilarityOptions) Cluster {
+	var members []int
+	for _, m := range c.Members {
+		members = append(members, prev[m].Members...)
+	}
+	result := Cluster{Members: members,
+		Similarities: make([]float64, len(members))}
+	result.Similarities[0] = 1
+	rep := sk.At(members[0])
+	for i, m := range members[1:] {
+		result.Similarities[i+1] = similarity(sk.At(m), rep, opts)
+	}
+	result.sortMembers()
+	return result
+}
+
+// Returns the clusters with each member moved to the cluster of its
+// most similar representative.
+func (sk *Sketches) reassign(ctx context.Context, clusters []Cluster,
+	opts ClusterOptions) ([]Cluster, error) {
+	idx := sketching.NewIndex(sk.Scale * idxScale)
+	result := make([]Cluster, len(clusters))
+	for i, c := range clusters {
+		idx.Add(sk.Hashes[c.Members[0]], i)
+		result[i] = Cluster{Members: c.Members[:1:1],
+			Similarities: c.Similarities[:1:1]}
+	}
+	for i, c := range clusters {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for j, m := range c.Members[1:] {
+			s := sk.At(m)
+			best, bestSim := i, c.Similarities[j+1]
+			cands := idx.Search(s.Hashes)
+			slices.Sort(cands) // For deterministic output.
+			for _, r := range cands {
+				rep := sk.At(clusters[r].Members[0])
+				sim := similarity(s, rep, opts.SimilarityOptions)
+				if sim > bestSim {
+					best, bestSim = r, sim
+				}
+			}
+			result[best].Members = append(result[best].Members, m)
+			result[best].Similarities = append(result[best].Similarities,
+				bestSim)
+		}
+	}
+	return result, nil
+}
+
+// Extension is the result of adding sketches to existing clusters.
+type Extension struct {
+	// Sorted serial numbers of the sketches that joined each existing
+	// cluster, by the cluster's serial number.
+	Joined [][]int
+
+	// Similarities of the joined sketches to their representatives,
+	// parallel to Joined.
+	Similarities [][]float64
+
+	// Clusters of the sketches that joined no existing cluster,
+	// ordered like in Cluster.
+	New []Cluster
+}
+
+// ExtendClusters adds the sketches to existing clusters, whose
+// representatives are given in reps.
+// Each sketch joins the cluster of its most similar representative,
+// if their similarity is at least the minimum.
+// The other sketches are clustered among themselves, like in Cluster,
+// using the selected mode.
+func (sk *Sketches) ExtendClusters(ctx context.Context, reps *Sketches,
+	opts ClusterOptions) (*Extension, error) {
+	if reps.K != sk.K || reps.Scale != sk.Scale {
+		return nil, fmt.Errorf("mismatching k or scale: "+
+			"k=%d scale=%d, representatives have k=%d scale=%d",
+			sk.K, sk.Scale, reps.K, reps.Scale)
+	}
+	if sk.Len() > 0 && reps.Len() > 0 &&
+		(sk.Counts != nil) != (reps.Counts != nil) {
+		return nil, fmt.Errorf("mismatching abundance tracking: " +
+			"only one of the sketches and representatives has counts")
+	}
+	if err := opts.check(sk, reps); err != nil {
+		return nil, err
+	}
+	ext := &Extension{
+		Joined:       make([][]int, reps.Len()),
+		Similarities: make([][]float64, reps.Len()),
+	}
+	ref := NewReference(reps)
+	done := make([]bool, sk.Len())
+	for i := range sk.Len() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		s := sk.At(i)
+		best, bestSim := -1, 0.0
+		for _, r := range ref.Candidates(s.Hashes) {
+			sim := similarity(s, reps.At(r), opts.SimilarityOptions)
+			if sim >= opts.MinSimilarity && (best == -1 || sim > bestSim) {
+				best, bestSim = r, sim
+			}
+		}
+		if best == -1 {
+			continue
+		}
+		ext.Joined[best] = append(ext.Joined[best], i)
+		ext.Similarities[best] = append(ext.Similarities[best], bestSim)
+		done[i] = true
+	}
+
+	var err error
+	ext.New, err = sk.clusterRest(ctx, done, opts)
+	if err != nil {
+		return nil, err
+	}
+	return ext, nil
+}
+
+// ClusterStats summarizes a cluster.
+type ClusterStats struct {
+	Size int // Number of members, including the representative.
+
+	// Minimal and mean similarity of the members to the representative,
+	// excluding the representative. 1 for singletons.
+	MinSimilarity  float64
+	MeanSimilarity float64
+
+	MinLength int // Length of the shortest member.
+	MaxLength int // Length of the longest member.
+}
+
+// Stats returns summary statistics of the cluster, whose members are
+// from the given sketches.
+func (c Cluster) Stats(sk *Sketches) ClusterStats {
+	st := ClusterStats{
+		Size:           len(c.Members),
+		MinSimilarity:  1,
+		MeanSimilarity: 1,
+		MinLength:      sk.Lengths[c.Members[0]],
+		MaxLength:      sk.Lengths[c.Members[0]],
+	}
+	if sims := c.Similarities[1:]; len(sims) > 0 {
+		st.MinSimilarity = slices.Min(sims)
+		sum := 0.0
+		for _, s := range sims {
+			sum += s
+		}
+		st.MeanSimilarity = sum / float64(len(sims))
+	}
+	for _, m := range c.Members[1:] {
+		st.MinLength = min(st.MinLength, sk.Lengths[m])
+		st.MaxLength = max(st.MaxLength, sk.Lengths[m])
+	}
+	return st
+}
+
+// Sorts the members, except for the representative.
+func (c Cluster) sortMembers() {
+	m, s := c.Members[1:], c.Similarities[1:]
+	perm := sortedPerm(m, cmp.Compare)
+	mm, ss := slices.Clone(m), slices.Clone(s)
+	for i, p := range perm {
+		m[i], s[i] = mm[p], ss[p]
+	}
+}
+
+// Returns the indexes of slice elements if they were sorted.
+func sortedPerm[T any](s []T, cmp func(T, T) int) []int {
+	return snm.SortedFunc(
+		snm.Slice(len(s), func(i int) int { return i }),
+		func(i, j int) int { return cmp(s[i], s[j]) },
+	)
+}
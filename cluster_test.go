@@ -0,0 +1,309 @@
+package blini
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/fluhus/gostuff/snm"
+)
+
+func TestSortedPerm(t *testing.T) {
+	input := []string{"a", "g", "d", "b"}
+	want := []int{0, 3, 2, 1}
+	got := sortedPerm(input, cmp.Compare)
+	if !slices.Equal(got, want) {
+		t.Fatalf("sortedPerm(%q)=%v, want %v", input, got, want)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	a := snm.Slice(100, func(i int) uint64 { return uint64(i) })
+	b := snm.Slice(100, func(i int) uint64 { return uint64(i + 1000) })
+	sk := &Sketches{
+		Hashes:  [][]uint64{a[:90], b, a, b[:95], {5000}},
+		Lengths: []int{90, 100, 100, 95, 1},
+		Names:   []string{"a1", "b1", "a2", "b2", "c"},
+		Records: make([][]int, 5),
+		Scale:   1,
+		K:       21,
+	}
+	opts := ClusterOptions{
+		SimilarityOptions: SimilarityOptions{Containment: true},
+		MinSimilarity:     0.9,
+	}
+	got, err := sk.Cluster(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Cluster(...) failed: %v", err)
+	}
+	sim := func(i, j int) float64 {
+		return similarity(sk.At(i), sk.At(j), opts.SimilarityOptions)
+	}
+	want := []Cluster{
+		{[]int{1, 3}, []float64{1, sim(3, 1)}},
+		{[]int{2, 0}, []float64{1, sim(0, 2)}},
+		{[]int{4}, []float64{1}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Cluster(...)=%v, want %v", got, want)
+	}
+}
+
+func TestClusterStats(t *testing.T) {
+	sk := &Sketches{Lengths: []int{90, 100, 95, 120}}
+	tests := []struct {
+		c    Cluster
+		want ClusterStats
+	}{
+		{Cluster{[]int{1, 0, 2, 3}, []float64{1, 0.9, 0.96, 0.93}},
+			ClusterStats{4, 0.9, 0.93, 90, 120}},
+		{Cluster{[]int{2}, []float64{1}}, ClusterStats{1, 1, 1, 95, 95}},
+	}
+	for _, test := range tests {
+		got := test.c.Stats(sk)
+		if got.Size != test.want.Size ||
+			math.Abs(got.MinSimilarity-test.want.MinSimilarity) > 1e-9 ||
+			math.Abs(got.MeanSimilarity-test.want.MeanSimilarity) > 1e-9 ||
+			got.MinLength != test.want.MinLength ||
+			got.MaxLength != test.want.MaxLength {
+			t.Errorf("%v.Stats()=%v, want %v", test.c, got, test.want)
+		}
+	}
+}
+
+func TestExtendClusters(t *testing.T) {
+	a := snm.Slice(100, func(i int) uint64 { return uint64(i) })
+	b := snm.Slice(100, func(i int) uint64 { return uint64(i + 1000) })
+	c := snm.Slice(100, func(i int) uint64 { return uint64(i + 2000) })
+	reps := &Sketches{
+		Hashes:  [][]uint64{a, b},
+		Lengths: []int{100, 100},
+		Names:   []string{"a", "b"},
+		Records: make([][]int, 2),
+		Scale:   1,
+		K:       21,
+	}
+	sk := &Sketches{
+		Hashes:  [][]uint64{c[:95], b[:95], c, a[:90], {5000}},
+		Lengths: []int{95, 95, 100, 90, 1},
+		Names:   []string{"c1", "b1", "c2", "a1", "d"},
+		Records: make([][]int, 5),
+		Scale:   1,
+		K:       21,
+	}
+	opts := ClusterOptions{
+		SimilarityOptions: SimilarityOptions{Containment: true},
+		MinSimilarity:     0.9,
+	}
+	got, err := sk.ExtendClusters(context.Background(), reps, opts)
+	if err != nil {
+		t.Fatalf("ExtendClusters(...) failed: %v", err)
+	}
+	sim := func(s, r Sketch) float64 {
+		return similarity(s, r, opts.SimilarityOptions)
+	}
+	want := &Extension{
+		Joined: [][]int{{3}, {1}},
+		Similarities: [][]float64{
+			{sim(sk.At(3), reps.At(0))},
+			{sim(sk.At(1), reps.At(1))},
+		},
+		New: []Cluster{
+			{[]int{2, 0}, []float64{1, sim(sk.At(0), sk.At(2))}},
+			{[]int{4}, []float64{1}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ExtendClusters(...)=%v, want %v", got, want)
+	}
+}
+
+func TestExtendClusters_counts(t *testing.T) {
+	sk := &Sketches{Hashes: [][]uint64{{1}}, Lengths: []int{1},
+		Names: []string{"a"}, Records: make([][]int, 1),
+		Counts: [][]uint32{{1}}, Scale: 1, K: 21}
+	reps := &Sketches{Hashes: [][]uint64{{1}}, Lengths: []int{1},
+		Names: []string{"b"}, Records: make([][]int, 1), Scale: 1, K: 21}
+	opts := ClusterOptions{SimilarityOptions: SimilarityOptions{
+		Abundance: true}}
+	_, err := sk.ExtendClusters(context.Background(), reps, opts)
+	if err == nil {
+		t.Fatalf("ExtendClusters(reps without counts) succeeded, want error")
+	}
+	_, err = sk.ExtendClusters(context.Background(), reps, ClusterOptions{})
+	if err == nil {
+		t.Fatalf("ExtendClusters(reps without counts, no abundance) " +
+			"succeeded, want error")
+	}
+	if _, err := reps.Cluster(context.Background(), opts); err == nil {
+		t.Fatalf("Cluster(without counts) succeeded, want error")
+	}
+}
+
+func TestCluster_reassign(t *testing.T) {
+	hashes := func(from, to int) []uint64 {
+		return snm.Slice(to-from, func(i int) uint64 {
+			return uint64(from + i)
+		})
+	}
+	sk := &Sketches{
+		Hashes:  [][]uint64{hashes(45, 125), hashes(0, 100), hashes(60, 159)},
+		Lengths: []int{80, 100, 99},
+		Names:   []string{"m", "r1", "r2"},
+		Records: make([][]int, 3),
+		Scale:   1,
+		K:       21,
+	}
+	opts := ClusterOptions{
+		SimilarityOptions: SimilarityOptions{Containment: true},
+		MinSimilarity:     0.97,
+	}
+	sim := func(i, j int) float64 {
+		return similarity(sk.At(i), sk.At(j), opts.SimilarityOptions)
+	}
+
+	got, err := sk.Cluster(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Cluster(...) failed: %v", err)
+	}
+	want := []Cluster{
+		{[]int{1, 0}, []float64{1, sim(0, 1)}},
+		{[]int{2}, []float64{1}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Cluster(...)=%v, want %v", got, want)
+	}
+
+	opts.Reassign = true
+	got, err = sk.Cluster(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Cluster(Reassign) failed: %v", err)
+	}
+	want = []Cluster{
+		{[]int{1}, []float64{1}},
+		{[]int{2, 0}, []float64{1, sim(0, 2)}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Cluster(Reassign)=%v, want %v", got, want)
+	}
+}
+
+func TestClusterLevels(t *testing.T) {
+	hashes := func(from, n int) []uint64 {
+		return snm.Slice(n, func(i int) uint64 { return uint64(from + i) })
+	}
+	sk := &Sketches{
+		Hashes: [][]uint64{hashes(0, 100), hashes(0, 98), hashes(40, 100),
+			hashes(1000, 100)},
+		Lengths: []int{100, 98, 99, 100},
+		Names:   []string{"a", "a2", "b", "c"},
+		Records: make([][]int, 4),
+		Scale:   1,
+		K:       21,
+	}
+	opts := ClusterOptions{
+		SimilarityOptions: SimilarityOptions{Containment: true},
+	}
+	sim := func(i, j int) float64 {
+		return similarity(sk.At(i), sk.At(j), opts.SimilarityOptions)
+	}
+	got, err := sk.ClusterLevels(context.Background(),
+		[]float64{0.99, 0.97}, opts)
+	if err != nil {
+		t.Fatalf("ClusterLevels(...) failed: %v", err)
+	}
+	want := [][]Cluster{
+		{
+			{[]int{0, 1}, []float64{1, sim(1, 0)}},
+			{[]int{2}, []float64{1}},
+			{[]int{3}, []float64{1}},
+		},
+		{
+			{[]int{0, 1, 2}, []float64{1, sim(1, 0), sim(2, 0)}},
+			{[]int{3}, []float64{1}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ClusterLevels(...)=%v, want %v", got, want)
+	}
+
+	_, err = sk.ClusterLevels(context.Background(), []float64{0.9, 0.95}, opts)
+	if err == nil {
+		t.Fatalf("ClusterLevels(ascending) succeeded, want error")
+	}
+}
+
+func TestCluster_rep(t *testing.T) {
+	hashes := func(n int) []uint64 {
+		return snm.Slice(n, func(i int) uint64 { return uint64(i) })
+	}
+	sk := &Sketches{
+		Hashes:  [][]uint64{hashes(98), hashes(100), hashes(99), hashes(96)},
+		Lengths: []int{98, 100, 99, 96},
+		Names:   []string{"a", "b", "c", "d"},
+		Records: make([][]int, 4),
+		Scale:   1,
+		K:       21,
+	}
+	tests := []struct {
+		rep        RepSelection
+		priorities []int
+		want       []int
+	}{
+		{Longest, nil, []int{1, 0, 2, 3}},
+		{Shortest, nil, []int{3, 0, 1, 2}},
+		{InputOrder, nil, []int{0, 1, 2, 3}},
+		{Priority, []int{2, 1, 0, 2}, []int{2, 0, 1, 3}},
+	}
+	for _, test := range tests {
+		for _, mode := range []ClusterMode{Greedy, SingleLinkage} {
+			opts := ClusterOptions{
+				SimilarityOptions: SimilarityOptions{Containment: true},
+				Mode:              mode,
+				Rep:               test.rep,
+				Priorities:        test.priorities,
+				MinSimilarity:     0.9,
+			}
+			got, err := sk.Cluster(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("Cluster(rep %d) failed: %v", test.rep, err)
+			}
+			if len(got) != 1 || !slices.Equal(got[0].Members, test.want) {
+				t.Errorf("Cluster(rep %d, mode %d)=%v, want members %v",
+					test.rep, mode, got, test.want)
+			}
+		}
+	}
+
+	opts := ClusterOptions{Rep: Priority, Priorities: []int{1}}
+	if _, err := sk.Cluster(context.Background(), opts); err == nil {
+		t.Errorf("Cluster(bad priorities) succeeded, want error")
+	}
+}
+
+func TestCentroid(t *testing.T) {
+	hashes := func(from int) []uint64 {
+		return snm.Slice(100, func(i int) uint64 { return uint64(from + i) })
+	}
+	sk := &Sketches{
+		Hashes:  [][]uint64{hashes(0), hashes(50), hashes(100)},
+		Lengths: []int{100, 100, 100},
+		Names:   []string{"a", "b", "c"},
+		Records: make([][]int, 3),
+		Scale:   1,
+		K:       21,
+	}
+	opts := SimilarityOptions{Containment: true}
+	sim := func(i, j int) float64 {
+		return similarity(sk.At(i), sk.At(j), opts)
+	}
+	c := Cluster{[]int{0, 1, 2}, []float64{1, sim(1, 0), sim(2, 0)}}
+	got := sk.centroid(c, opts)
+	want := Cluster{[]int{1, 0, 2}, []float64{1, sim(0, 1), sim(2, 1)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("centroid(%v)=%v, want %v", c, got, want)
+	}
+}
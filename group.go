@@ -0,0 +1,186 @@
+// Genome grouping logic.
+
+package blini
+
+import (
+	"cmp"
+	"fmt"
+	"iter"
+	"slices"
+	"strings"
+
+	"github.com/fluhus/gostuff/csvx"
+)
+
+// Returns a function that maps a record name to its genome name,
+// according to the grouping options.
+// Returns nil if grouping is disabled.
+func newGrouper(opts SketchOptions) (func(file, name string) string, error) {
+	nset := 0
+	for _, b := range []bool{
+		opts.GroupRegexp != nil, opts.GroupByFile, opts.GroupMap != nil,
+	} {
+		if b {
+			nset++
+		}
+	}
+	if nset > 1 {
+		return nil, fmt.Errorf(
+			"only one of GroupRegexp, GroupByFile and GroupMap may be set")
+	}
+
+	switch {
+	case opts.GroupRegexp != nil:
+		re := opts.GroupRegexp
+		return func(file, name string) string {
+			m := re.FindStringSubmatch(name)
+			if m == nil {
+				return name
+			}
+			if len(m) > 1 { // Use the first group if present.
+				return m[1]
+			}
+			return m[0]
+		}, nil
+
+	case opts.GroupByFile:
+		return func(file, name string) string {
+			return fileBaseName(file)
+		}, nil
+
+	case opts.GroupMap != nil:
+		m := opts.GroupMap
+		return func(file, name string) string {
+			if g, ok := m[name]; ok {
+				return g
+			}
+			if f := strings.Fields(name); len(f) > 0 {
+				if g, ok := m[f[0]]; ok {
+					return g
+				}
+			}
+			return name
+		}, nil
+	}
+	return nil, nil
+}
+
+// ReadGroupMap reads a TSV file that maps record names (first column)
+// to genome names (second column), for use as SketchOptions.GroupMap.
+func ReadGroupMap(file string) (map[string]string, error) {
+	m := map[string]string{}
+	for line, err := range csvx.File(file, csvx.TSV) {
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 2 {
+			return nil, fmt.Errorf("%s: expected 2 columns, got %d",
+				file, len(line))
+		}
+		m[line[0]] = line[1]
+	}
+	return m, nil
+}
+
+// Merges consecutive sketch entries of the same genome into one entry,
+// yielding each genome when its records end, so that only one genome is
+// held in memory. Returns an error if a genome's records are not
+// consecutive.
+func groupSketches(seq iter.Seq2[Sketch, error], file string,
+	grp func(file, name string) string) iter.Seq2[Sketch, error] {
+	return func(yield func(Sketch, error) bool) {
+		done := map[string]bool{} // Names of yielded genomes.
+		var g Sketch              // Current genome.
+		var merged sketchMerger
+		started := false
+		finish := func() bool {
+			g.Hashes, g.Counts = merged.result()
+			done[g.Name] = true
+			merged = sketchMerger{}
+			return yield(g, nil)
+		}
+		for e, err := range seq {
+			if err != nil {
+				yield(Sketch{}, err)
+				return
+			}
+			name := grp(file, e.Name)
+			if !started || name != g.Name {
+				if started && !finish() {
+					return
+				}
+				if done[name] {
+					yield(Sketch{}, fmt.Errorf("%s: records of genome %q "+
+						"are not consecutive", file, name))
+					return
+				}
+				g = Sketch{Name: name, Scale: e.Scale, K: e.K}
+				started = true
+			}
+			g.Length += e.Length
+			g.Records = append(g.Records, e.Records...)
+			merged.add(e.Hashes, e.Counts)
+		}
+		if started {
+			finish()
+		}
+	}
+}
+
+// Accumulates the hashes of multiple sketches into one sketch,
+// summing their counts.
+type sketchMerger struct {
+	s       []uint64    // Merged hashes, sorted.
+	c       []uint32    // Merged counts.
+	pending []hashCount // Hashes that were not merged yet.
+}
+
+// A hash and its count.
+type hashCount struct {
+	h uint64
+	c uint32
+}
+
+// Adds the hashes of a sketch and their counts.
+func (m *sketchMerger) add(s []uint64, c []uint32) {
+	for i, h := range s {
+		m.pending = append(m.pending, hashCount{h, c[i]})
+	}
+	if len(m.pending) > len(m.s) { // Amortized merging.
+		m.flush()
+	}
+}
+
+// Merges the pending hashes into the merged hashes.
+func (m *sketchMerger) flush() {
+	p := m.pending
+	slices.SortFunc(p, func(a, b hashCount) int {
+		return cmp.Compare(a.h, b.h)
+	})
+	s := make([]uint64, 0, len(m.s)+len(p))
+	c := make([]uint32, 0, len(m.s)+len(p))
+	i, j := 0, 0
+	for i < len(m.s) || j < len(p) {
+		var hc hashCount
+		if j == len(p) || (i < len(m.s) && m.s[i] <= p[j].h) {
+			hc = hashCount{m.s[i], m.c[i]}
+			i++
+		} else {
+			hc = p[j]
+			j++
+		}
+		if len(s) > 0 && s[len(s)-1] == hc.h {
+			c[len(c)-1] += hc.c
+		} else {
+			s = append(s, hc.h)
+			c = append(c, hc.c)
+		}
+	}
+	m.s, m.c, m.pending = s, c, p[:0]
+}
+
+// Returns the merged sketch and its counts.
+func (m *sketchMerger) result() ([]uint64, []uint32) {
+	m.flush()
+	return slices.Clip(m.s), slices.Clip(m.c)
+}
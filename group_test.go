@@ -0,0 +1,63 @@
+package blini
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/fluhus/gostuff/ppln"
+)
+
+func TestGroupSketches(t *testing.T) {
+	input := []Sketch{
+		{Hashes: []uint64{1, 5}, Counts: []uint32{1, 2}, Length: 10,
+			Name: "a.1", Records: []int{0}},
+		{Hashes: []uint64{1, 3}, Counts: []uint32{5, 6}, Length: 30,
+			Name: "a.2", Records: []int{1}},
+		{Hashes: []uint64{2, 6}, Counts: []uint32{3, 4}, Length: 20,
+			Name: "b.1", Records: []int{2}},
+	}
+	want := []Sketch{
+		{Hashes: []uint64{1, 3, 5}, Counts: []uint32{6, 6, 2}, Length: 40,
+			Name: "a", Records: []int{0, 1}},
+		{Hashes: []uint64{2, 6}, Counts: []uint32{3, 4}, Length: 20,
+			Name: "b", Records: []int{2}},
+	}
+	grp := func(file, name string) string { return name[:1] }
+	var got []Sketch
+	for e, err := range groupSketches(ppln.SliceInput(input), "", grp) {
+		if err != nil {
+			t.Fatalf("groupSketches(...) failed: %v", err)
+		}
+		got = append(got, e)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("groupSketches(...)=%v, want %v", got, want)
+	}
+
+	// Records of a genome that are not consecutive.
+	input[1], input[2] = input[2], input[1]
+	var gotErr error
+	for _, err := range groupSketches(ppln.SliceInput(input), "", grp) {
+		if err != nil {
+			gotErr = err
+		}
+	}
+	if gotErr == nil {
+		t.Fatalf("groupSketches(not consecutive) succeeded, want error")
+	}
+}
+
+func TestSketchMerger(t *testing.T) {
+	var m sketchMerger
+	m.add([]uint64{3, 7}, []uint32{1, 1})
+	m.add([]uint64{1, 7, 9}, []uint32{2, 2, 2})
+	m.add([]uint64{1}, []uint32{1})
+	m.add([]uint64{2, 9}, []uint32{5, 1})
+	gotS, gotC := m.result()
+	wantS := []uint64{1, 2, 3, 7, 9}
+	wantC := []uint32{3, 5, 1, 3, 3}
+	if !slices.Equal(gotS, wantS) || !slices.Equal(gotC, wantC) {
+		t.Fatalf("result()=%v,%v, want %v,%v", gotS, gotC, wantS, wantC)
+	}
+}
@@ -0,0 +1,282 @@
+// Reference index I/O logic.
+
+package blini
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/fluhus/blini/sketching"
+	"github.com/fluhus/gostuff/aio"
+	"github.com/fluhus/gostuff/bnry"
+)
+
+const (
+	indexMagic   = "BLINI\x00IX" // Beginning of every index file.
+	indexVersion = 1             // Current index file format version.
+
+	// IndexFileSuffix is appended to a sketch file's name to get the name
+	// of its index file.
+	IndexFileSuffix = ".idx"
+
+	// MappedIndexFileSuffix is appended to a sketch file's name to get the
+	// name of its memory-mapped index file.
+	MappedIndexFileSuffix = ".mmi"
+)
+
+// Identifies the sketches an index was created for.
+type indexHeader struct {
+	version uint64 // Format version.
+	n       int    // Number of sketches.
+	hashes  int    // Total number of hashes in the sketches.
+	scale   uint64 // Kmer selection scale.
+	k       int    // Kmer length.
+	sum     uint64 // Checksum of the sketches' hashes.
+}
+
+// Returns the header of an index of the given sketches.
+func newIndexHeader(sk *Sketches) indexHeader {
+	h := indexHeader{indexVersion, sk.Len(), 0, sk.Scale, sk.K, 0}
+	crc := crc64.New(crc64.MakeTable(crc64.ECMA))
+	var buf []byte
+	for _, s := range sk.Hashes {
+		h.hashes += len(s)
+		buf = binary.LittleEndian.AppendUint64(buf[:0], uint64(len(s)))
+		for _, x := range s {
+			buf = binary.LittleEndian.AppendUint64(buf, x)
+		}
+		crc.Write(buf)
+	}
+	h.sum = crc.Sum64()
+	return h
+}
+
+// WriteIndex writes the reference's index, so that it can later be read
+// by ReadReference instead of being rebuilt.
+func (r *Reference) WriteIndex(w io.Writer) error {
+	idx, ok := r.idx.(*sketching.Index)
+	if !ok {
+		return fmt.Errorf("cannot write the index of a mapped reference")
+	}
+	if _, err := io.WriteString(w, indexMagic); err != nil {
+		return err
+	}
+	h := newIndexHeader(r.Sketches)
+	err := bnry.Write(w, h.version, h.n, h.hashes, h.scale, h.k, h.sum)
+	if err != nil {
+		return err
+	}
+	return idx.Write(w)
+}
+
+// ReadReference returns a reference of the given sketches,
+// using the index in the given file.
+// The index must have been written by WriteIndex for the same sketches.
+func ReadReference(sk *Sketches, file string) (*Reference, error) {
+	f, err := aio.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(indexMagic))
+	if _, err := io.ReadFull(f, magic); err != nil ||
+		string(magic) != indexMagic {
+		return nil, fmt.Errorf("%s: not a blini index file", file)
+	}
+	var h indexHeader
+	err = bnry.Read(f, &h.version)
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad index header: %w",
+			file, unexpected(err))
+	}
+	if h.version != indexVersion {
+		return nil, fmt.Errorf("%s: unsupported index version: %d, want %d",
+			file, h.version, indexVersion)
+	}
+	err = bnry.Read(f, &h.n, &h.hashes, &h.scale, &h.k, &h.sum)
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad index header: %w",
+			file, unexpected(err))
+	}
+	if h != newIndexHeader(sk) {
+		return nil, fmt.Errorf("%s: index does not match its sketches, "+
+			"re-create it", file)
+	}
+	idx, err := sketching.ReadIndex(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, unexpected(err))
+	}
+	return &Reference{sk, idx}, nil
+}
+
+// WriteMappedIndex writes the hashes, metadata and index of the sketches
+// in the given sketch file, in a format that can be memory-mapped by
+// OpenMappedReference. The sketches are read one at a time and the index
+// is built in temporary files, so the sketches need not fit in memory.
+func WriteMappedIndex(w io.Writer, sketchFile string) error {
+	stat, err := os.Stat(sketchFile)
+	if err != nil {
+		return err
+	}
+	// Names and lengths, and the abundance tracking in empty counts.
+	info := &Sketches{}
+	onHeader := func(h SketchFileHeader) {
+		if info.Len() == 0 && info.Scale == 0 && info.K == 0 {
+			info.Scale, info.K = h.Scale, h.K
+			if h.Counts {
+				info.Counts = [][]uint32{}
+			}
+		}
+	}
+	var mw *sketching.MappedIndexWriter
+	defer func() {
+		if mw != nil {
+			mw.Close()
+		}
+	}()
+	for e, err := range ReadSketchesFunc(sketchFile, onHeader) {
+		if err != nil {
+			return err
+		}
+		if mw == nil {
+			mw, err = sketching.NewMappedIndexWriter(info.Scale*idxScale,
+				info.Counts != nil)
+			if err != nil {
+				return err
+			}
+		}
+		hashes, counts := e.Hashes, e.Counts
+		e.Hashes, e.Counts = nil, e.Counts[:0:0]
+		if err := info.Add(e); err != nil {
+			return fmt.Errorf("%s: %w", sketchFile, err)
+		}
+		if err := mw.Add(hashes, counts); err != nil {
+			return fmt.Errorf("%s: %w", sketchFile, err)
+		}
+	}
+	if mw == nil {
+		if info.Scale == 0 {
+			return fmt.Errorf("%s: no sketches", sketchFile)
+		}
+		mw, err = sketching.NewMappedIndexWriter(info.Scale*idxScale,
+			info.Counts != nil)
+		if err != nil {
+			return err
+		}
+	}
+	meta := bnry.MarshalBinary(stat.Size(), stat.ModTime().UnixNano(),
+		info.K, info.Scale, info.Counts != nil, info.Names, info.Lengths)
+	return mw.Finish(w, meta)
+}
+
+// OpenMappedReference returns a reference of the sketches in the given
+// sketch file, whose hashes and index are memory-mapped from the given
+// mapped index file rather than loaded into memory.
+// The mapped index must have been written by WriteMappedIndex for the same
+// sketch file. It is considered stale if the sketch file's size or
+// modification time changed since.
+// Call Close when done.
+func OpenMappedReference(sketchFile, indexFile string) (*Reference, error) {
+	m, err := sketching.OpenMappedIndex(indexFile)
+	if err != nil {
+		return nil, err
+	}
+	sk, err := mappedSketches(m, sketchFile)
+	if err != nil {
+		m.Close()
+		return nil, fmt.Errorf("%s: %w", indexFile, err)
+	}
+	return &Reference{sk, m}, nil
+}
+
+// Returns the sketches of a mapped index, checking that it matches
+// the given sketch file.
+func mappedSketches(m *sketching.MappedIndex, sketchFile string,
+) (*Sketches, error) {
+	var size, modTime int64
+	var counts bool
+	sk := &Sketches{}
+	err := bnry.UnmarshalBinary(m.Meta(), &size, &modTime, &sk.K, &sk.Scale,
+		&counts, &sk.Names, &sk.Lengths)
+	if err != nil {
+		return nil, fmt.Errorf("bad metadata: %w", unexpected(err))
+	}
+	n := m.Len()
+	if len(sk.Names) != n || len(sk.Lengths) != n || sk.Scale == 0 {
+		return nil, fmt.Errorf("bad metadata: mismatching lengths")
+	}
+	if m.Max() != math.MaxUint64/(sk.Scale*idxScale) {
+		return nil, fmt.Errorf("index scale does not match its sketches' "+
+			"scale %d, re-create it", sk.Scale)
+	}
+	stat, err := os.Stat(sketchFile)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() != size || stat.ModTime().UnixNano() != modTime {
+		return nil, fmt.Errorf("index does not match its sketches, " +
+			"re-create it")
+	}
+	sk.Hashes = make([][]uint64, n)
+	sk.Records = make([][]int, n)
+	if counts {
+		sk.Counts = make([][]uint32, n)
+	}
+	for i := range n {
+		sk.Hashes[i] = m.Sketch(i)
+		if counts {
+			sk.Counts[i] = m.Counts(i)
+		}
+	}
+	return sk, nil
+}
+
+// LoadReference loads sketches using LoadSketches and indexes them.
+// If the input is a sketch file with an index file next to it,
+// the index is read rather than built.
+// A memory-mapped index is preferred over a regular one.
+// Call Close when done.
+func LoadReference(ctx context.Context, input string, opts SketchOptions,
+) (*Reference, error) {
+	if file, ok := MappedIndexFile(input); ok {
+		return OpenMappedReference(input, file)
+	}
+	sk, err := LoadSketches(ctx, input, opts)
+	if err != nil {
+		return nil, err
+	}
+	if file, ok := IndexFile(input); ok {
+		return ReadReference(sk, file)
+	}
+	return NewReference(sk), nil
+}
+
+// IndexFile returns the index file of the given input,
+// and whether it exists.
+func IndexFile(input string) (string, bool) {
+	return sideFile(input, IndexFileSuffix)
+}
+
+// MappedIndexFile returns the memory-mapped index file of the given input,
+// and whether it exists.
+func MappedIndexFile(input string) (string, bool) {
+	return sideFile(input, MappedIndexFileSuffix)
+}
+
+// Returns the file with the given suffix next to a sketch file,
+// and whether it exists.
+func sideFile(input, suffix string) (string, bool) {
+	if !strings.HasSuffix(input, SketchFileSuffix) {
+		return "", false
+	}
+	file := input + suffix
+	_, err := os.Stat(file)
+	return file, err == nil
+}
@@ -0,0 +1,190 @@
+package blini
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fluhus/blini/sketching"
+	"github.com/fluhus/gostuff/aio"
+)
+
+func TestLoadReference(t *testing.T) {
+	sk := &Sketches{
+		Hashes:  [][]uint64{{1, 2, 3}, {2, 3, 4}, {10, 11}},
+		Lengths: []int{100, 100, 50},
+		Names:   []string{"a", "b", "c"},
+		Records: make([][]int, 3),
+		Scale:   1,
+		K:       21,
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a"+SketchFileSuffix)
+	writeFile(t, file, func(f *aio.Writer) error {
+		return WriteSketches(f, sk)
+	})
+	if _, ok := IndexFile(file); ok {
+		t.Fatalf("IndexFile(%q) exists, want not", file)
+	}
+	writeFile(t, file+IndexFileSuffix, func(f *aio.Writer) error {
+		return NewReference(sk).WriteIndex(f)
+	})
+	if _, ok := IndexFile(file); !ok {
+		t.Fatalf("IndexFile(%q) does not exist, want exists", file)
+	}
+
+	ref, err := LoadReference(context.Background(), file, SketchOptions{})
+	if err != nil {
+		t.Fatalf("LoadReference(%q) failed: %v", file, err)
+	}
+	for i, s := range sk.Hashes {
+		want := NewReference(sk).Candidates(s)
+		if got := ref.Candidates(s); !reflect.DeepEqual(got, want) {
+			t.Errorf("Candidates(#%d)=%v, want %v", i, got, want)
+		}
+	}
+
+	// Index of other sketches.
+	sk2 := *sk
+	sk2.Hashes = sk.Hashes[:2]
+	sk2.Lengths, sk2.Names, sk2.Records = sk.Lengths[:2], sk.Names[:2],
+		sk.Records[:2]
+	writeFile(t, file+IndexFileSuffix, func(f *aio.Writer) error {
+		return NewReference(&sk2).WriteIndex(f)
+	})
+	if _, err := LoadReference(context.Background(), file,
+		SketchOptions{}); err == nil {
+		t.Fatalf("LoadReference(mismatching index) succeeded, want error")
+	}
+
+	// Index of sketches of the same sizes.
+	sk3 := *sk
+	sk3.Hashes = [][]uint64{{1, 2, 3}, {2, 3, 4}, {10, 12}}
+	writeFile(t, file+IndexFileSuffix, func(f *aio.Writer) error {
+		return NewReference(&sk3).WriteIndex(f)
+	})
+	if _, err := LoadReference(context.Background(), file,
+		SketchOptions{}); err == nil {
+		t.Fatalf("LoadReference(mismatching hashes) succeeded, want error")
+	}
+}
+
+// Creates a file using the given write function.
+func writeFile(t *testing.T, file string, write func(*aio.Writer) error) {
+	f, err := aio.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := write(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenMappedReference(t *testing.T) {
+	sk := &Sketches{
+		Hashes:  [][]uint64{{1, 2, 3}, {2, 3, 4}, {10, 11}},
+		Lengths: []int{100, 100, 50},
+		Names:   []string{"a", "b", "c"},
+		Records: make([][]int, 3),
+		Counts:  [][]uint32{{1, 1, 1}, {2, 2, 2}, {3, 3}},
+		Scale:   1,
+		K:       21,
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a"+SketchFileSuffix)
+	writeFile(t, file, func(f *aio.Writer) error {
+		return WriteSketches(f, sk)
+	})
+	writeFile(t, file+MappedIndexFileSuffix, func(f *aio.Writer) error {
+		return WriteMappedIndex(f, file)
+	})
+
+	ref, err := LoadReference(context.Background(), file, SketchOptions{})
+	if err != nil {
+		t.Fatalf("LoadReference(%q) failed: %v", file, err)
+	}
+	if !reflect.DeepEqual(ref.Sketches.Hashes, sk.Hashes) ||
+		!reflect.DeepEqual(ref.Sketches.Counts, sk.Counts) ||
+		!reflect.DeepEqual(ref.Sketches.Names, sk.Names) ||
+		!reflect.DeepEqual(ref.Sketches.Lengths, sk.Lengths) {
+		t.Fatalf("LoadReference(%q)=%v, want %v", file, ref.Sketches, sk)
+	}
+	for i, s := range sk.Hashes {
+		want := NewReference(sk).Candidates(s)
+		if got := ref.Candidates(s); !reflect.DeepEqual(got, want) {
+			t.Errorf("Candidates(#%d)=%v, want %v", i, got, want)
+		}
+	}
+	if err := ref.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if ref.Sketches.Hashes != nil || ref.Sketches.Counts != nil {
+		t.Fatalf("Close() kept hashes or counts of the unmapped file")
+	}
+
+	// Index of an older sketch file.
+	sk2 := *sk
+	sk2.Hashes = [][]uint64{{1, 2, 3}, {2, 3, 4}, {10, 12}}
+	writeFile(t, file, func(f *aio.Writer) error {
+		return WriteSketches(f, &sk2)
+	})
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenMappedReference(file, file+MappedIndexFileSuffix)
+	if err == nil {
+		t.Fatalf("OpenMappedReference(mismatching index) succeeded, " +
+			"want error")
+	}
+}
+
+func TestOpenMappedReference_scale(t *testing.T) {
+	sk := &Sketches{
+		Hashes:  [][]uint64{{1, 2, 3}},
+		Lengths: []int{100},
+		Names:   []string{"a"},
+		Records: make([][]int, 1),
+		Scale:   1,
+		K:       21,
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a"+SketchFileSuffix)
+	writeFile(t, file, func(f *aio.Writer) error {
+		return WriteSketches(f, sk)
+	})
+	writeFile(t, file+MappedIndexFileSuffix, func(f *aio.Writer) error {
+		return WriteMappedIndex(f, file)
+	})
+
+	// Replace the index with one of another scale and the same metadata.
+	m, err := sketching.OpenMappedIndex(file + MappedIndexFileSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := slices.Clone(m.Meta())
+	m.Close()
+	writeFile(t, file+MappedIndexFileSuffix, func(f *aio.Writer) error {
+		mw, err := sketching.NewMappedIndexWriter(2, false)
+		if err != nil {
+			return err
+		}
+		defer mw.Close()
+		if err := mw.Add(sk.Hashes[0], nil); err != nil {
+			return err
+		}
+		return mw.Finish(f, meta)
+	})
+	_, err = OpenMappedReference(file, file+MappedIndexFileSuffix)
+	if err == nil {
+		t.Fatalf("OpenMappedReference(mismatching scale) succeeded, " +
+			"want error")
+	}
+}
@@ -0,0 +1,265 @@
+// Input file logic.
+
+package blini
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/fluhus/biostuff/formats/fasta"
+	"github.com/fluhus/biostuff/formats/fastq"
+	"github.com/fluhus/blini/sketching"
+	"github.com/fluhus/gostuff/aio"
+	"github.com/fluhus/gostuff/csvx"
+	"github.com/fluhus/gostuff/ppln"
+)
+
+var (
+	// Suffixes of compressed files.
+	compressionSuffixes = []string{".gz", ".zst", ".bz2", ".xz"}
+
+	// Suffixes of sequence files.
+	sequenceSuffixes = []string{
+		".fa", ".fna", ".fasta", ".ffn", ".fas", ".fq", ".fastq",
+	}
+)
+
+// Offset of fastq quality characters.
+const phredOffset = 33
+
+// InputFile is a sequence file that is sketched as a single unit.
+type InputFile struct {
+	Path string // File path.
+	Name string // Sketch name.
+}
+
+// InputFiles returns the files given by a directory, glob or manifest input.
+// Returns nil if the input is a single sequence file, in which case
+// each record (or group of records) is a separate sketch.
+func InputFiles(input string) ([]InputFile, error) {
+	stat, err := os.Stat(input)
+	switch {
+	case err == nil && stat.IsDir():
+		return dirFiles(input)
+	case err == nil && isManifest(input):
+		return manifestFiles(input)
+	case err == nil:
+		return nil, nil
+	case os.IsNotExist(err) && strings.ContainsAny(input, "*?["):
+		return globFiles(input)
+	default:
+		return nil, err
+	}
+}
+
+// Returns the sequence files in a directory.
+func dirFiles(dir string) ([]InputFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var result []InputFile
+	for _, e := range entries {
+		if !isSequenceFile(e.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		info, err := os.Stat(path) // Follows symlinks.
+		if os.IsNotExist(err) {
+			continue // Broken symlink.
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		result = append(result, InputFile{path, fileBaseName(path)})
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no sequence files found in %q", dir)
+	}
+	return result, nil
+}
+
+// Returns the files that match a glob pattern.
+func globFiles(pattern string) ([]InputFile, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no files match %q", pattern)
+	}
+	var result []InputFile
+	for _, path := range paths {
+		result = append(result, InputFile{path, fileBaseName(path)})
+	}
+	return result, nil
+}
+
+// Returns the files listed in a manifest: a TSV with file paths and
+// optional names. Relative paths are relative to the manifest's directory.
+func manifestFiles(manifest string) ([]InputFile, error) {
+	dir := filepath.Dir(manifest)
+	var result []InputFile
+	for line, err := range csvx.File(manifest, csvx.TSV, variableFields) {
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] == "" {
+			continue
+		}
+		path := line[0]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		name := fileBaseName(path)
+		if len(line) > 1 && line[1] != "" {
+			name = line[1]
+		}
+		result = append(result, InputFile{path, name})
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no files listed in %q", manifest)
+	}
+	return result, nil
+}
+
+// Allows CSV lines to have different numbers of fields.
+func variableFields(r *csv.Reader) {
+	r.FieldsPerRecord = -1
+}
+
+// Returns whether the file is a manifest, according to its name.
+func isManifest(file string) bool {
+	return strings.HasSuffix(strings.ToLower(file), ".tsv")
+}
+
+// Returns whether the file is a sequence file, according to its name.
+func isSequenceFile(file string) bool {
+	name := trimSuffixes(strings.ToLower(file), compressionSuffixes)
+	return slices.Contains(sequenceSuffixes, filepath.Ext(name))
+}
+
+// Returns the file's name without directory and known suffixes.
+func fileBaseName(file string) string {
+	name := filepath.Base(file)
+	name = trimSuffixes(name, compressionSuffixes)
+	return trimSuffixes(name, sequenceSuffixes)
+}
+
+// Removes the last extension of name if it is one of the given suffixes.
+// Does not remove the entire name.
+func trimSuffixes(name string, suffixes []string) string {
+	ext := filepath.Ext(name)
+	if ext == name || !slices.Contains(suffixes, strings.ToLower(ext)) {
+		return name
+	}
+	return name[:len(name)-len(ext)]
+}
+
+// SketchInput sketches the given input, which may be a single sequence file,
+// a directory, a glob pattern or a manifest.
+// Sketching is done using multiple threads, maintaining input order.
+func SketchInput(input string, opts SketchOptions) iter.Seq2[Sketch, error] {
+	return func(yield func(Sketch, error) bool) {
+		files, err := InputFiles(input)
+		if err != nil {
+			yield(Sketch{}, err)
+			return
+		}
+		seq := sketchFile(input, opts)
+		if files != nil {
+			if opts.GroupRegexp != nil || opts.GroupMap != nil {
+				yield(Sketch{}, fmt.Errorf("grouping by regexp or map "+
+					"is not supported with multiple input files"))
+				return
+			}
+			seq = sketchFiles(files, opts)
+		}
+		for e, err := range seq {
+			if !yield(e, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Sketches each file as a single sketch.
+func sketchFiles(files []InputFile, opts SketchOptions,
+) iter.Seq2[Sketch, error] {
+	k, scale := opts.K, opts.Scale
+	return serialSeq(opts.threads(), ppln.SliceInput(files),
+		func(f InputFile, i int) (Sketch, error) {
+			e := Sketch{Name: f.Name, Scale: scale, K: k}
+			var m sketchMerger
+			for fa, err := range SequenceFile(f.Path, opts.MinQuality) {
+				if err != nil {
+					return Sketch{}, fmt.Errorf("%s: %w", f.Path, err)
+				}
+				m.add(sketching.SketchCounts(fa.Sequence, k, scale))
+				e.Length += len(fa.Sequence)
+			}
+			e.Hashes, e.Counts = m.result()
+			finishAbundance(&e, opts)
+			return e, nil
+		})
+}
+
+// SequenceFile iterates over the records of a fasta or fastq file,
+// detecting the format by the first character.
+// If minQual is positive, fastq bases with lower quality are masked
+// so that kmers that contain them are skipped.
+func SequenceFile(file string, minQual int) iter.Seq2[*fasta.Fasta, error] {
+	return func(yield func(*fasta.Fasta, error) bool) {
+		f, err := aio.Open(file)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer f.Close()
+
+		b, err := f.Peek(1)
+		if err != nil && err != io.EOF {
+			yield(nil, err)
+			return
+		}
+		if len(b) == 0 || b[0] != '@' {
+			for fa, err := range fasta.Reader(f) {
+				if !yield(fa, err) || err != nil {
+					return
+				}
+			}
+			return
+		}
+
+		for fq, err := range fastq.Reader(f) {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if minQual > 0 {
+				maskQuals(fq, minQual)
+			}
+			if !yield(&fasta.Fasta{Name: fq.Name, Sequence: fq.Sequence}, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Replaces bases with quality lower than minQual with N.
+func maskQuals(fq *fastq.Fastq, minQual int) {
+	for i, q := range fq.Quals {
+		if int(q)-phredOffset < minQual {
+			fq.Sequence[i] = 'N'
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package blini
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestFileBaseName(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"a.fa", "a"},
+		{"dir/GCF_123.1.fna.gz", "GCF_123.1"},
+		{"/x/y/genome.FASTA.zst", "genome"},
+		{"reads.txt", "reads.txt"},
+		{".fa", ".fa"},
+	}
+	for _, test := range tests {
+		if got := fileBaseName(test.input); got != test.want {
+			t.Errorf("fileBaseName(%q)=%q, want %q",
+				test.input, got, test.want)
+		}
+	}
+}
+
+func TestInputFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"a.fa", "b.fna.gz", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, f), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := filepath.Join(dir, "m.tsv")
+	err := os.WriteFile(manifest, []byte("a.fa\tgenome_a\nb.fna.gz\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []InputFile{
+		{filepath.Join(dir, "a.fa"), "a"},
+		{filepath.Join(dir, "b.fna.gz"), "b"},
+	}
+	wantManifest := []InputFile{
+		{filepath.Join(dir, "a.fa"), "genome_a"},
+		{filepath.Join(dir, "b.fna.gz"), "b"},
+	}
+	tests := []struct {
+		input string
+		want  []InputFile
+	}{
+		{dir, want},
+		{filepath.Join(dir, "*.f*"), want},
+		{manifest, wantManifest},
+		{filepath.Join(dir, "a.fa"), nil},
+	}
+	for _, test := range tests {
+		got, err := InputFiles(test.input)
+		if err != nil {
+			t.Fatalf("InputFiles(%q) failed: %v", test.input, err)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("InputFiles(%q)=%v, want %v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestInputFiles_symlinks(t *testing.T) {
+	dir, other := t.TempDir(), t.TempDir()
+	target := filepath.Join(other, "target.fa")
+	if err := os.WriteFile(target, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(other, "sub.fa"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"a.fa":      target,
+		"b.fa":      filepath.Join(other, "sub.fa"),
+		"broken.fa": filepath.Join(other, "missing.fa"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Skipf("Symlink failed: %v", err)
+		}
+	}
+	want := []InputFile{{filepath.Join(dir, "a.fa"), "a"}}
+	got, err := InputFiles(dir)
+	if err != nil {
+		t.Fatalf("InputFiles(%q) failed: %v", dir, err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("InputFiles(%q)=%v, want %v", dir, got, want)
+	}
+}
+
+func TestSeqFile(t *testing.T) {
+	dir := t.TempDir()
+	fa := filepath.Join(dir, "a.fa")
+	fq := filepath.Join(dir, "a.fq")
+	if err := os.WriteFile(fa, []byte(">a\nACGT\n>b\nGGCC\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := os.WriteFile(fq, []byte("@a\nACGT\n+\nII#I\n@b\nGGCC\n+\n#III\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file    string
+		minQual int
+		want    []string
+	}{
+		{fa, 0, []string{"a", "ACGT", "b", "GGCC"}},
+		{fa, 20, []string{"a", "ACGT", "b", "GGCC"}},
+		{fq, 0, []string{"a", "ACGT", "b", "GGCC"}},
+		{fq, 20, []string{"a", "ACNT", "b", "NGCC"}},
+	}
+	for _, test := range tests {
+		var got []string
+		for rec, err := range SequenceFile(test.file, test.minQual) {
+			if err != nil {
+				t.Fatalf("SequenceFile(%q,%d) failed: %v",
+					test.file, test.minQual, err)
+			}
+			got = append(got, string(rec.Name), string(rec.Sequence))
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("SequenceFile(%q,%d)=%q, want %q",
+				test.file, test.minQual, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Single-linkage clustering logic.
+
+package blini
+
+import (
+	"cmp"
+	"context"
+	"slices"
+
+	"github.com/fluhus/blini/sketching"
+)
+
+// Clusters the sketches that are not done into connected components,
+// and marks them as done. Linked pairs are pairs that share indexed
+// hashes and have at least the minimal similarity (in either direction).
+// Representatives are chosen by the order of Rep.
+func (sk *Sketches) linkageClusters(ctx context.Context,
+	idx *sketching.Index, done []bool, opts ClusterOptions,
+) ([]Cluster, error) {
+	perm, err := sk.repOrder(opts)
+	if err != nil {
+		return nil, err
+	}
+	rank := make([]int, len(perm)) // Preference as a representative.
+	for i, p := range perm {
+		rank[p] = i
+	}
+
+	uf := newUnionFind(sk.Len())
+	for i := range sk.Len() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if done[i] {
+			continue
+		}
+		s := sk.At(i)
+		for _, f := range idx.Search(s.Hashes) {
+			if f <= i || done[f] || uf.find(f) == uf.find(i) {
+				continue
+			}
+			if !linked(s, sk.At(f), opts) {
+				continue
+			}
+			uf.union(i, f)
+		}
+	}
+
+	// Group members by their roots.
+	groups := map[int][]int{}
+	for i := range sk.Len() {
+		if !done[i] {
+			root := uf.find(i)
+			groups[root] = append(groups[root], i)
+			done[i] = true
+		}
+	}
+	var clusters []Cluster
+	for _, g := range groups {
+		slices.SortFunc(g, func(a, b int) int {
+			return cmp.Compare(rank[a], rank[b])
+		})
+		rep := sk.At(g[0])
+		c := Cluster{Members: g, Similarities: make([]float64, len(g))}
+		c.Similarities[0] = 1
+		for j, m := range g[1:] {
+			c.Similarities[j+1] = similarity(sk.At(m), rep,
+				opts.SimilarityOptions)
+		}
+		c.sortMembers()
+		clusters = append(clusters, c)
+	}
+	slices.SortFunc(clusters, func(a, b Cluster) int {
+		return cmp.Compare(a.Members[0], b.Members[0])
+	})
+	return clusters, nil
+}
+
+// Returns whether the similarity of a and b is at least the minimum,
+// in either direction.
+func linked(a, b Sketch, opts ClusterOptions) bool {
+	sim := similarity(a, b, opts.SimilarityOptions)
+	if sim < opts.MinSimilarity && opts.Containment {
+		sim = similarity(b, a, opts.SimilarityOptions)
+	}
+	return sim >= opts.MinSimilarity
+}
+
+// A union-find (disjoint set) structure over 0..n-1.
+type unionFind []int
+
+// Returns a union-find where each element is in its own set.
+func newUnionFind(n int) unionFind {
+	uf := make(unionFind, n)
+	for i := range uf {
+		uf[i] = i
+	}
+	return uf
+}
+
+// Returns the root of i's set.
+func (uf unionFind) find(i int) int {
+	for uf[i] != i {
+		uf[i] = uf[uf[i]] // Path halving.
+		i = uf[i]
+	}
+	return i
+}
+
+// Merges the sets of i and j.
+func (uf unionFind) union(i, j int) {
+	uf[uf.find(i)] = uf.find(j)
+}
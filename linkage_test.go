@@ -0,0 +1,60 @@
+package blini
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/fluhus/gostuff/snm"
+)
+
+func TestCluster_linkage(t *testing.T) {
+	hashes := func(from int) []uint64 {
+		return snm.Slice(100, func(i int) uint64 { return uint64(from + i) })
+	}
+	// A chain: a~b and b~c are similar, c and d share few hashes.
+	sk := &Sketches{
+		Hashes:  [][]uint64{hashes(0), hashes(40), hashes(80), hashes(175)},
+		Lengths: []int{100, 100, 100, 100},
+		Names:   []string{"a", "b", "c", "d"},
+		Records: make([][]int, 4),
+		Scale:   1,
+		K:       21,
+	}
+	opts := ClusterOptions{
+		SimilarityOptions: SimilarityOptions{Containment: true},
+		MinSimilarity:     0.97,
+	}
+	sim := func(i, j int) float64 {
+		return similarity(sk.At(i), sk.At(j), opts.SimilarityOptions)
+	}
+	want := []Cluster{
+		{[]int{0, 1, 2}, []float64{1, sim(1, 0), sim(2, 0)}},
+		{[]int{3}, []float64{1}},
+	}
+	opts.Mode = SingleLinkage
+	got, err := sk.Cluster(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Cluster(SingleLinkage) failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Cluster(SingleLinkage)=%v, want %v", got, want)
+	}
+
+	opts.Reassign = true
+	if _, err := sk.Cluster(context.Background(), opts); err == nil {
+		t.Errorf("Cluster(SingleLinkage, Reassign) succeeded, want error")
+	}
+}
+
+func TestUnionFind(t *testing.T) {
+	uf := newUnionFind(5)
+	uf.union(0, 3)
+	uf.union(4, 3)
+	want := []bool{true, false, false, true, true}
+	for i, w := range want {
+		if got := uf.find(i) == uf.find(0); got != w {
+			t.Errorf("same set(0, %d)=%v, want %v", i, got, w)
+		}
+	}
+}
@@ -15,7 +15,7 @@ go run ./paper/gentestdata $datadir/viral.1.1.genomic.fna.gz
 # PRE-SKETCH REFERENCE DATASET
 
 mkdir -p $outdir
-blini -r $datadir/viral.1.1.genomic.fna.gz -o $outdir/viral.blini
+blini sketch -i $datadir/viral.1.1.genomic.fna.gz -o $outdir/viral.blini
 sourmash sketch dna --singleton $datadir/viral.1.1.genomic.fna.gz -o $outdir/viral.sm
 mmseqs createdb $datadir/viral.1.1.genomic.fna.gz $outdir/viral.mm
 
@@ -23,8 +23,8 @@ mmseqs createdb $datadir/viral.1.1.genomic.fna.gz $outdir/viral.mm
 ## SEARCH TASKS
 
 # Search genomes with blini.
-time blini -q $fastadir/vir_all.fa -r $outdir/viral.blini -o $outdir/blini_vir.csv
-time blini -q $fastadir/mut_all.fa -r $outdir/viral.blini -o $outdir/blini_mut.csv
+time blini search -q $fastadir/vir_all.fa -r $outdir/viral.blini -o $outdir/blini_vir.csv
+time blini search -q $fastadir/mut_all.fa -r $outdir/viral.blini -o $outdir/blini_mut.csv
 
 # Searches a single file with sourmash.
 function smsearch {
@@ -58,11 +58,16 @@ go run ./paper/testsearch
 for s in 25 50 100 200; do
   reset
   for i in 1 2 3 4 5; do
-    time blini -q testdata/fasta/clust_snps.fa -o $outdir/blini_$s -s $s -c -m 0.97
+    time blini cluster -i testdata/fasta/clust_snps.fa -o $outdir/blini_$s -s $s -c -m 0.97
   done
   read -p "Done $s"
 done
 
+# Blini cluster with reassignment.
+for s in 25 50 100 200; do
+  blini cluster -i testdata/fasta/clust_snps.fa -o $outdir/blini_r$s -s $s -c -m 0.97 -reassign
+done
+
 # MMseqs cluster.
 for t in 1 4; do
   reset
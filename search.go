@@ -0,0 +1,153 @@
+// Search logic.
+
+package blini
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"iter"
+	"slices"
+
+	"github.com/fluhus/blini/sketching"
+	"github.com/fluhus/gostuff/heaps"
+)
+
+// Reference is a set of sketches, indexed for searching.
+type Reference struct {
+	Sketches *Sketches // The indexed sketches.
+	idx      searcher
+}
+
+// An index that finds sketches that share hashes with a given sketch.
+type searcher interface {
+	Search(s []uint64) []int
+}
+
+// NewReference returns a reference that searches the given sketches.
+// The sketches should not be modified while the reference is in use.
+func NewReference(sk *Sketches) *Reference {
+	return &Reference{sk, newIndex(sk)}
+}
+
+// Returns an index of the given sketches.
+func newIndex(sk *Sketches) *sketching.Index {
+	idx := sketching.NewIndex(sk.Scale * idxScale)
+	for i, s := range sk.Hashes {
+		idx.Add(s, i)
+	}
+	return idx
+}
+
+// Close releases the resources of a memory-mapped reference.
+// The hashes and counts of its sketches are cleared, since they point to
+// the unmapped file.
+// It is a no-op for other references.
+func (r *Reference) Close() error {
+	if m, ok := r.idx.(*sketching.MappedIndex); ok {
+		r.Sketches.Hashes, r.Sketches.Counts = nil, nil
+		return m.Close()
+	}
+	return nil
+}
+
+// Candidates returns the sorted serial numbers of the reference sketches
+// that share indexed hashes with the given hashes.
+func (r *Reference) Candidates(hashes []uint64) []int {
+	cands := r.idx.Search(hashes)
+	slices.Sort(cands) // For deterministic output.
+	return cands
+}
+
+// SearchOptions control searching.
+type SearchOptions struct {
+	SimilarityOptions
+
+	MinSimilarity float64 // Minimal similarity for a hit.
+	Threads       int     // Number of threads to use; 0 means 1.
+	Top           int     // Keep only the N best hits; 0 keeps all.
+}
+
+// Hit is a reference sketch that matches a query.
+type Hit struct {
+	Reference  int     // Serial number of the reference sketch.
+	Name       string  // Name of the reference sketch.
+	Similarity float64 // Similarity between the query and the reference.
+}
+
+// SearchResult holds the hits of a single query.
+type SearchResult struct {
+	Query Sketch // The query sketch.
+
+	// Hits, ordered by reference serial number.
+	// If SearchOptions.Top is set, ordered from best to worst.
+	Hits []Hit
+}
+
+// Search looks up the query sketches in the reference and iterates over
+// the results, in query order.
+// Searching is done using multiple threads.
+func (r *Reference) Search(ctx context.Context, query iter.Seq2[Sketch, error],
+	opts SearchOptions) iter.Seq2[SearchResult, error] {
+	query = withContext(ctx, query)
+	return serialSeq(max(opts.Threads, 1), query,
+		func(q Sketch, i int) (SearchResult, error) {
+			hits, err := r.SearchSketch(q, opts)
+			if err != nil {
+				return SearchResult{}, err
+			}
+			return SearchResult{q, hits}, nil
+		})
+}
+
+// SearchSketch looks up a single query sketch in the reference
+// and returns its hits.
+func (r *Reference) SearchSketch(q Sketch, opts SearchOptions,
+) ([]Hit, error) {
+	sk := r.Sketches
+	if q.K != sk.K || q.Scale != sk.Scale {
+		return nil, fmt.Errorf("query %q has k=%d scale=%d, "+
+			"reference has k=%d scale=%d", q.Name, q.K, q.Scale, sk.K, sk.Scale)
+	}
+	if opts.Abundance && (q.Counts == nil || sk.Counts == nil) {
+		return nil, fmt.Errorf("abundance similarity requires hash counts")
+	}
+	var hits []Hit
+	var top *heaps.Heap[Hit] // Best hits, with the worst at the head.
+	if opts.Top > 0 {
+		top = heaps.New(func(a, b Hit) bool { return compareHits(a, b) > 0 })
+	}
+	for _, f := range r.Candidates(q.Hashes) {
+		sim := similarity(q, sk.At(f), opts.SimilarityOptions)
+		if sim < opts.MinSimilarity {
+			continue
+		}
+		hit := Hit{f, sk.Names[f], sim}
+		switch {
+		case top == nil:
+			hits = append(hits, hit)
+		case top.Len() < opts.Top:
+			top.Push(hit)
+		case compareHits(hit, top.Head()) < 0:
+			top.Pop()
+			top.Push(hit)
+		}
+	}
+	if top != nil && top.Len() > 0 {
+		hits = slices.Clone(top.View())
+		slices.SortFunc(hits, compareHits)
+	}
+	return hits, nil
+}
+
+// Compares hits by similarity (descending), then by name and serial
+// number, so that better hits come first.
+func compareHits(a, b Hit) int {
+	if c := cmp.Compare(b.Similarity, a.Similarity); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.Name, b.Name); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Reference, b.Reference)
+}
@@ -0,0 +1,106 @@
+package blini
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/fluhus/gostuff/ppln"
+	"github.com/fluhus/gostuff/snm"
+)
+
+func TestSearch(t *testing.T) {
+	a := snm.Slice(100, func(i int) uint64 { return uint64(i) })
+	b := snm.Slice(100, func(i int) uint64 { return uint64(i + 1000) })
+	ref := NewReference(&Sketches{
+		Hashes:  [][]uint64{a, b, a[:50]},
+		Lengths: []int{100, 100, 50},
+		Names:   []string{"a", "b", "a_half"},
+		Records: make([][]int, 3),
+		Scale:   1,
+		K:       21,
+	})
+	queries := []Sketch{
+		{Name: "q1", Hashes: a[:40], Length: 40, Scale: 1, K: 21},
+		{Name: "q2", Hashes: b, Length: 100, Scale: 1, K: 21},
+		{Name: "q3", Hashes: []uint64{5000}, Length: 1, Scale: 1, K: 21},
+	}
+	opts := SearchOptions{
+		SimilarityOptions: SimilarityOptions{Containment: true},
+		MinSimilarity:     0.9,
+		Threads:           2,
+	}
+	want := [][]string{{"a", "a_half"}, {"b"}, nil}
+	var got [][]string
+	for r, err := range ref.Search(context.Background(),
+		ppln.SliceInput(queries), opts) {
+		if err != nil {
+			t.Fatalf("Search(...) failed: %v", err)
+		}
+		var names []string
+		for _, h := range r.Hits {
+			if h.Similarity < 0.99 {
+				t.Errorf("Search(%q) similarity=%f, want >=0.99",
+					r.Query.Name, h.Similarity)
+			}
+			names = append(names, h.Name)
+		}
+		got = append(got, names)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Search(...)=%v, want %v", got, want)
+	}
+
+	// Mismatching k.
+	q := queries[0]
+	q.K = 15
+	if _, err := ref.SearchSketch(q, opts); err == nil {
+		t.Fatalf("SearchSketch(k=15) succeeded, want error")
+	}
+}
+
+func TestSearch_cancel(t *testing.T) {
+	ref := NewReference(&Sketches{Scale: 1, K: 21})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	queries := ppln.SliceInput([]Sketch{{Scale: 1, K: 21}})
+	for _, err := range ref.Search(ctx, queries, SearchOptions{}) {
+		if err == nil {
+			t.Fatalf("Search(canceled) succeeded, want error")
+		}
+	}
+}
+
+func TestSearch_top(t *testing.T) {
+	a := snm.Slice(100, func(i int) uint64 { return uint64(i) })
+	ref := NewReference(&Sketches{
+		Hashes:  [][]uint64{a[:80], a, a[:90], a, a[:50]},
+		Lengths: []int{80, 100, 90, 100, 50},
+		Names:   []string{"r80", "r100b", "r90", "r100a", "r50"},
+		Records: make([][]int, 5),
+		Scale:   1,
+		K:       21,
+	})
+	q := Sketch{Name: "q", Hashes: a, Length: 100, Scale: 1, K: 21}
+	tests := []struct {
+		top  int
+		want []string
+	}{
+		{0, []string{"r80", "r100b", "r90", "r100a", "r50"}},
+		{1, []string{"r100a"}},
+		{3, []string{"r100a", "r100b", "r90"}},
+		{10, []string{"r100a", "r100b", "r90", "r80", "r50"}},
+	}
+	for _, test := range tests {
+		hits, err := ref.SearchSketch(q, SearchOptions{Top: test.top})
+		if err != nil {
+			t.Fatalf("SearchSketch(top=%d) failed: %v", test.top, err)
+		}
+		got := snm.SliceToSlice(hits, func(h Hit) string { return h.Name })
+		if !slices.Equal(got, test.want) {
+			t.Errorf("SearchSketch(top=%d)=%v, want %v",
+				test.top, got, test.want)
+		}
+	}
+}
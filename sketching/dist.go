@@ -36,6 +36,59 @@ func Containment(a, b []uint64) float64 {
 	return float64(i) / float64(u)
 }
 
+// WeightedJaccard returns the abundance-weighted Jaccard similarity
+// between a and b, where ac and bc are the counts of their hashes.
+func WeightedJaccard(a []uint64, ac []uint32, b []uint64, bc []uint32,
+) float64 {
+	mn, mx := weightedMinMax(a, ac, b, bc)
+	return float64(mn) / float64(mx+ghostUnion)
+}
+
+// WeightedContainment returns the abundance-weighted containment of a in b,
+// where ac and bc are the counts of their hashes.
+func WeightedContainment(a []uint64, ac []uint32, b []uint64, bc []uint32,
+) float64 {
+	mn, _ := weightedMinMax(a, ac, b, bc)
+	u := 0
+	for _, c := range ac {
+		u += int(c)
+	}
+	if compensatingCont {
+		u += u - mn
+	}
+	return float64(mn) / float64(u+ghostUnion)
+}
+
+// Returns the sums of the minimal and maximal counts of each hash
+// in the union of a and b.
+func weightedMinMax(a []uint64, ac []uint32, b []uint64, bc []uint32,
+) (int, int) {
+	mn, mx := 0, 0
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			mx += int(ac[i])
+			i++
+		case a[i] > b[j]:
+			mx += int(bc[j])
+			j++
+		default:
+			mn += int(min(ac[i], bc[j]))
+			mx += int(max(ac[i], bc[j]))
+			i++
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		mx += int(ac[i])
+	}
+	for ; j < len(b); j++ {
+		mx += int(bc[j])
+	}
+	return mn, mx
+}
+
 // MyDist returns a Mash distance with compensation for length
 // difference.
 func MyDist(a, b []uint64, alen, blen int, k int) float64 {
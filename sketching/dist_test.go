@@ -26,3 +26,37 @@ func TestJaccard(t *testing.T) {
 		}
 	}
 }
+
+func TestWeightedJaccard(t *testing.T) {
+	tests := []struct {
+		a      []uint64
+		ac     []uint32
+		b      []uint64
+		bc     []uint32
+		want   float64
+		wantAB float64 // Containment of a in b.
+	}{
+		{[]uint64{1}, []uint32{3}, nil, nil, 0, 0},
+		{[]uint64{1}, []uint32{3}, []uint64{1}, []uint32{3},
+			3.0 / (3 + ghostUnion), 3.0 / (3 + ghostUnion)},
+		{[]uint64{1, 2}, []uint32{1, 4}, []uint64{2, 3}, []uint32{2, 5},
+			2.0 / (10 + ghostUnion), 2.0 / (8 + ghostUnion)},
+	}
+	for _, test := range tests {
+		got := WeightedJaccard(test.a, test.ac, test.b, test.bc)
+		if got != test.want {
+			t.Errorf("WeightedJaccard(%v,%v,%v,%v)=%v, want %v",
+				test.a, test.ac, test.b, test.bc, got, test.want)
+		}
+		got = WeightedJaccard(test.b, test.bc, test.a, test.ac)
+		if got != test.want {
+			t.Errorf("WeightedJaccard(%v,%v,%v,%v)=%v, want %v",
+				test.b, test.bc, test.a, test.ac, got, test.want)
+		}
+		got = WeightedContainment(test.a, test.ac, test.b, test.bc)
+		if got != test.wantAB {
+			t.Errorf("WeightedContainment(%v,%v,%v,%v)=%v, want %v",
+				test.a, test.ac, test.b, test.bc, got, test.wantAB)
+		}
+	}
+}
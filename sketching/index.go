@@ -3,7 +3,7 @@
 package sketching
 
 import (
-	"fmt"
+	"io"
 	"math"
 
 	"github.com/fluhus/gostuff/sets"
@@ -48,14 +48,45 @@ func (idx *Index) Search(s []uint64) []int {
 	return maps.Keys(set)
 }
 
-// Clean removes keys with only one element.
+// Clean removes keys with only one element, and returns the numbers of
+// keys before and after.
 // Use only for clustering.
-func (idx *Index) Clean() {
+func (idx *Index) Clean() (int, int) {
 	n1 := len(idx.idx)
 	idx.idx = snm.FilterMap(idx.idx, func(k uint64, v []int) bool {
 		return len(v) > 1
 	})
 	n2 := len(idx.idx)
-	fmt.Printf("Cleaning: %d ==> %d (%.0f%%)\n",
-		n1, n2, float64(n2)/float64(n1)*100)
+	return n1, n2
+}
+
+// Write writes the index in a binary format, to be read by ReadIndex.
+func (idx *Index) Write(w io.Writer) error {
+	l := indexLayout{mx: idx.mx}
+	l.keys = snm.Sorted(maps.Keys(idx.idx))
+	l.singles = make([]int, len(l.keys))
+	for i, k := range l.keys {
+		v := idx.idx[k]
+		l.singles[i] = v[0]
+		if len(v) > 1 {
+			l.mkeys = append(l.mkeys, k)
+			l.mlens = append(l.mlens, len(v)-1)
+			l.multis = append(l.multis, v[1:]...)
+		}
+	}
+	return l.write(w)
+}
+
+// Returns an index with the given layout.
+func indexFromLayout(l *indexLayout) *Index {
+	idx := &Index{idx: make(map[uint64][]int, len(l.keys)), mx: l.mx}
+	for i, k := range l.keys {
+		idx.idx[k] = []int{l.singles[i]}
+	}
+	multis := l.multis
+	for i, k := range l.mkeys {
+		idx.idx[k] = append(idx.idx[k], multis[:l.mlens[i]]...)
+		multis = multis[l.mlens[i]:]
+	}
+	return idx
 }
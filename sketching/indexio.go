@@ -0,0 +1,84 @@
+package sketching
+
+import (
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/fluhus/gostuff/bnry"
+)
+
+// Version of the binary index format.
+const indexVersion = 1
+
+// Binary layout of an index, with each key's first value in singles
+// and the remaining values in multis.
+type indexLayout struct {
+	mx      uint64   // Maximal indexed hash.
+	keys    []uint64 // Sorted keys.
+	singles []int    // First value of each key.
+	mkeys   []uint64 // Sorted keys with more than one value.
+	mlens   []int    // Number of additional values of each key in mkeys.
+	multis  []int    // Additional values, concatenated.
+}
+
+// Writes the layout, delta-encoding the keys.
+func (l *indexLayout) write(w io.Writer) error {
+	return bnry.Write(w, uint64(indexVersion), l.mx,
+		deltas(l.keys), l.singles, deltas(l.mkeys), l.mlens, l.multis)
+}
+
+// Reads a layout that was written by write.
+func (l *indexLayout) read(r io.ByteReader) error {
+	var version uint64
+	if err := bnry.Read(r, &version); err != nil {
+		return err
+	}
+	if version != indexVersion {
+		return fmt.Errorf("unsupported index version: %d, want %d",
+			version, indexVersion)
+	}
+	err := bnry.Read(r, &l.mx, &l.keys, &l.singles, &l.mkeys, &l.mlens,
+		&l.multis)
+	if err != nil {
+		return err
+	}
+	undeltas(l.keys)
+	undeltas(l.mkeys)
+	if len(l.keys) != len(l.singles) || len(l.mkeys) != len(l.mlens) {
+		return fmt.Errorf("bad index: mismatching lengths")
+	}
+	sum := 0
+	for _, n := range l.mlens {
+		sum += n
+	}
+	if sum != len(l.multis) {
+		return fmt.Errorf("bad index: mismatching lengths")
+	}
+	return nil
+}
+
+// Returns the differences between consecutive elements of a sorted slice.
+func deltas(a []uint64) []uint64 {
+	d := slices.Clone(a)
+	for i := len(d) - 1; i > 0; i-- {
+		d[i] -= d[i-1]
+	}
+	return d
+}
+
+// Reverses deltas, in place.
+func undeltas(d []uint64) {
+	for i := 1; i < len(d); i++ {
+		d[i] += d[i-1]
+	}
+}
+
+// ReadIndex reads an index that was written by Index.Write.
+func ReadIndex(r io.ByteReader) (*Index, error) {
+	var l indexLayout
+	if err := l.read(r); err != nil {
+		return nil, err
+	}
+	return indexFromLayout(&l), nil
+}
@@ -0,0 +1,46 @@
+package sketching
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestIndexWriteRead(t *testing.T) {
+	sketches := [][]uint64{{1, 5, 9}, {5, 10}, {1, 5, 100}, {math.MaxUint64}}
+	idx := NewIndex(1)
+	for i, s := range sketches {
+		idx.Add(s, i)
+	}
+	buf := &bytes.Buffer{}
+	if err := idx.Write(buf); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	got, err := ReadIndex(bufio.NewReader(buf))
+	if err != nil {
+		t.Fatalf("ReadIndex() failed: %v", err)
+	}
+	for _, s := range append(sketches, []uint64{9, 10}, []uint64{7}) {
+		want := slices.Sorted(slices.Values(idx.Search(s)))
+		found := slices.Sorted(slices.Values(got.Search(s)))
+		if !slices.Equal(found, want) {
+			t.Errorf("Search(%v)=%v, want %v", s, found, want)
+		}
+	}
+}
+
+func TestIndexRead_truncated(t *testing.T) {
+	idx := NewIndex(1)
+	idx.Add([]uint64{1, 2, 3}, 0)
+	idx.Add([]uint64{2, 3, 4}, 1)
+	buf := &bytes.Buffer{}
+	if err := idx.Write(buf); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	b := buf.Bytes()[:buf.Len()-2]
+	if _, err := ReadIndex(bytes.NewReader(b)); err == nil {
+		t.Fatalf("ReadIndex(truncated) succeeded, want error")
+	}
+}
@@ -3,10 +3,11 @@
 package sketching
 
 import (
-	"fmt"
+	"io"
 	"math"
 
 	"github.com/fluhus/gostuff/sets"
+	"github.com/fluhus/gostuff/snm"
 	"golang.org/x/exp/maps"
 )
 
@@ -49,13 +50,50 @@ func (idx *Index) Search(s []uint64) []int {
 	return maps.Keys(set)
 }
 
-// Clean removes keys with only one element.
+// Clean removes keys with only one element, and returns the numbers of
+// keys before and after.
 // Use only for clustering.
-func (idx *Index) Clean() {
+func (idx *Index) Clean() (int, int) {
 	n1 := len(idx.idx.singles)
 	n2 := len(idx.idx.slices)
 	idx.idx.clearSingles()
 	idx.idx.singles = maps.Clone(idx.idx.singles) // Reduce memory footprint.
-	fmt.Printf("Cleaning: %d ==> %d (%.0f%%)\n",
-		n1, n2, float64(n2)/float64(n1)*100)
+	return n1, n2
+}
+
+// Write writes the index in a binary format, to be read by ReadIndex.
+func (idx *Index) Write(w io.Writer) error {
+	l := indexLayout{mx: idx.mx}
+	l.keys = snm.Sorted(maps.Keys(idx.idx.singles))
+	l.singles = make([]int, len(l.keys))
+	for i, k := range l.keys {
+		l.singles[i] = idx.idx.singles[k]
+	}
+	l.mkeys = snm.Sorted(maps.Keys(idx.idx.slices))
+	l.mlens = make([]int, len(l.mkeys))
+	for i, k := range l.mkeys {
+		l.mlens[i] = len(idx.idx.slices[k])
+		l.multis = append(l.multis, idx.idx.slices[k]...)
+	}
+	return l.write(w)
+}
+
+// Returns an index with the given layout.
+func indexFromLayout(l *indexLayout) *Index {
+	idx := &Index{
+		idx: svmap[uint64, int]{
+			singles: make(map[uint64]int, len(l.keys)),
+			slices:  make(map[uint64][]int, len(l.mkeys)),
+		},
+		mx: l.mx,
+	}
+	for i, k := range l.keys {
+		idx.idx.singles[k] = l.singles[i]
+	}
+	multis := l.multis
+	for i, k := range l.mkeys {
+		idx.idx.slices[k] = multis[:l.mlens[i]:l.mlens[i]]
+		multis = multis[l.mlens[i]:]
+	}
+	return idx
 }
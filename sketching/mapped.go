@@ -0,0 +1,593 @@
+package sketching
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"unsafe"
+
+	"github.com/fluhus/gostuff/heaps"
+)
+
+// Mapped index file layout. All numbers are little-endian.
+//
+//	magic     8 bytes
+//	header    mappedHeaderLen uint64s (see mappedIndexHeader)
+//	keys      nkeys uint64s, sorted indexed hashes
+//	offsets   nkeys+1 uint64s, start of each key's postings
+//	postings  nposts uint32s, sketch serial numbers, padded to 8 bytes
+//	soffsets  nsketches+1 uint64s, start of each sketch in hashes
+//	hashes    nhashes uint64s, all sketches concatenated
+//	counts    ncounts uint32s, hash counts (0 or nhashes), padded to 8 bytes
+//	meta      nmeta bytes, caller-defined metadata
+const (
+	mappedMagic     = "BLINIMX\x00"
+	mappedVersion   = 1
+	mappedHeaderLen = 8
+)
+
+// Header of a mapped index file.
+type mappedIndexHeader struct {
+	version   uint64
+	mx        uint64 // Maximal indexed hash.
+	nkeys     uint64 // Number of indexed hashes.
+	nposts    uint64 // Number of postings.
+	nsketches uint64 // Number of sketches.
+	nhashes   uint64 // Total number of hashes in the sketches.
+	ncounts   uint64 // Total number of hash counts.
+	nmeta     uint64 // Length of the metadata.
+}
+
+// Number of postings that are sorted in memory at a time when writing
+// a mapped index.
+var mappedRunLen = 1 << 24
+
+// An indexed hash and the serial number of its sketch.
+type posting struct {
+	h uint64
+	i uint32
+}
+
+// Compares postings by hash, then by serial number.
+func comparePostings(a, b posting) int {
+	if c := cmp.Compare(a.h, b.h); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.i, b.i)
+}
+
+// MappedIndexWriter writes sketches and an index of their hashes,
+// in a format that can be memory-mapped by OpenMappedIndex.
+// Sketches are added one at a time and are kept in temporary files,
+// where the index is built using an external sort,
+// so memory use does not grow with the number of sketches.
+type MappedIndexWriter struct {
+	h        mappedIndexHeader
+	counts   bool        // Whether sketches have hash counts.
+	dir      string      // Directory of temporary files.
+	temps    []*tempFile // All temporary files, for closing.
+	soffsets *tempFile   // Start of each sketch in hashes.
+	hashes   *tempFile   // Sketch hashes.
+	cnts     *tempFile   // Hash counts.
+	run      []posting   // Postings that were not sorted yet.
+	runs     []*tempFile // Sorted runs of postings.
+}
+
+// NewMappedIndexWriter returns a writer of sketches and an index of 1/scale
+// of their hashes. If counts is true, each sketch must come with its hash
+// counts. Temporary files are created in the default directory for
+// temporary files. Call Close when done.
+func NewMappedIndexWriter(scale uint64, counts bool,
+) (*MappedIndexWriter, error) {
+	dir, err := os.MkdirTemp("", "blini-mmi-")
+	if err != nil {
+		return nil, err
+	}
+	w := &MappedIndexWriter{
+		h: mappedIndexHeader{
+			version: mappedVersion,
+			mx:      math.MaxUint64 / scale,
+		},
+		counts: counts,
+		dir:    dir,
+	}
+	for _, t := range []**tempFile{&w.soffsets, &w.hashes, &w.cnts} {
+		if *t, err = w.newTemp(); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Add adds a sorted sketch and its hash counts (nil if the writer
+// has no counts).
+func (w *MappedIndexWriter) Add(s []uint64, counts []uint32) error {
+	if w.h.nsketches == math.MaxUint32 {
+		return fmt.Errorf("too many sketches: %d", w.h.nsketches+1)
+	}
+	if w.counts && len(counts) != len(s) {
+		return fmt.Errorf("sketch #%d has %d counts for %d hashes",
+			w.h.nsketches+1, len(counts), len(s))
+	}
+	if !w.counts && counts != nil {
+		return fmt.Errorf("sketch #%d has unexpected counts",
+			w.h.nsketches+1)
+	}
+	i := uint32(w.h.nsketches)
+	w.soffsets.u64(w.h.nhashes)
+	w.hashes.u64(s...)
+	w.cnts.u32(counts...)
+	w.h.nsketches++
+	w.h.nhashes += uint64(len(s))
+	for _, x := range s {
+		if x > w.h.mx {
+			break
+		}
+		w.run = append(w.run, posting{x, i})
+		if len(w.run) == mappedRunLen {
+			if err := w.flushRun(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Sorts the current postings and writes them to a new run file.
+func (w *MappedIndexWriter) flushRun() error {
+	t, err := w.newTemp()
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(w.run, comparePostings)
+	for _, p := range w.run {
+		t.u64(p.h)
+		t.u32(p.i)
+	}
+	w.runs = append(w.runs, t)
+	w.run = w.run[:0]
+	return t.err
+}
+
+// Finish writes the sketches, their index and the given metadata to out.
+func (w *MappedIndexWriter) Finish(out io.Writer, meta []byte) error {
+	if len(w.run) > 0 {
+		if err := w.flushRun(); err != nil {
+			return err
+		}
+	}
+	w.run = nil
+	w.soffsets.u64(w.h.nhashes)
+	if w.counts {
+		w.h.ncounts = w.h.nhashes
+		if w.h.ncounts%2 == 1 {
+			w.cnts.u32(0) // Padding.
+		}
+	}
+	w.h.nmeta = uint64(len(meta))
+
+	// Merge the runs into keys, offsets and postings.
+	keys, err := w.newTemp()
+	if err != nil {
+		return err
+	}
+	offsets, err := w.newTemp()
+	if err != nil {
+		return err
+	}
+	posts, err := w.newTemp()
+	if err != nil {
+		return err
+	}
+	err = w.mergeRuns(func(p posting, first bool) {
+		if first {
+			keys.u64(p.h)
+			offsets.u64(w.h.nposts)
+			w.h.nkeys++
+		}
+		posts.u32(p.i)
+		w.h.nposts++
+	})
+	if err != nil {
+		return err
+	}
+	offsets.u64(w.h.nposts)
+	if w.h.nposts%2 == 1 {
+		posts.u32(0) // Padding.
+	}
+
+	bw := bufio.NewWriter(out)
+	mw := &mappedWriter{w: bw}
+	h := w.h
+	mw.bytes([]byte(mappedMagic))
+	mw.u64(h.version, h.mx, h.nkeys, h.nposts, h.nsketches, h.nhashes,
+		h.ncounts, h.nmeta)
+	if mw.err != nil {
+		return mw.err
+	}
+	for _, t := range []*tempFile{keys, offsets, posts, w.soffsets, w.hashes,
+		w.cnts} {
+		if err := t.copyTo(bw); err != nil {
+			return err
+		}
+	}
+	mw.bytes(meta)
+	if mw.err != nil {
+		return mw.err
+	}
+	return bw.Flush()
+}
+
+// Calls f on the postings of all runs, in sorted order.
+// First is true for the first posting of each hash.
+func (w *MappedIndexWriter) mergeRuns(f func(p posting, first bool)) error {
+	hp := heaps.New(func(a, b *runReader) bool {
+		return comparePostings(a.cur, b.cur) < 0
+	})
+	for _, t := range w.runs {
+		r, err := t.reader()
+		if err != nil {
+			return err
+		}
+		rr := &runReader{r: r}
+		ok, err := rr.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			hp.Push(rr)
+		}
+	}
+	var last posting
+	for n := 0; hp.Len() > 0; n++ {
+		rr := hp.Head()
+		f(rr.cur, n == 0 || rr.cur.h != last.h)
+		last = rr.cur
+		ok, err := rr.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			hp.Fix(0)
+		} else {
+			hp.Pop()
+		}
+	}
+	return nil
+}
+
+// Close removes the writer's temporary files.
+func (w *MappedIndexWriter) Close() error {
+	for _, t := range w.temps {
+		t.f.Close()
+	}
+	w.temps = nil
+	return os.RemoveAll(w.dir)
+}
+
+// Creates a temporary file in the writer's directory.
+func (w *MappedIndexWriter) newTemp() (*tempFile, error) {
+	f, err := os.CreateTemp(w.dir, "")
+	if err != nil {
+		return nil, err
+	}
+	t := &tempFile{f: f, b: bufio.NewWriter(f)}
+	t.w = t.b
+	w.temps = append(w.temps, t)
+	return t, nil
+}
+
+// A temporary file that is written sequentially and then read back.
+type tempFile struct {
+	mappedWriter
+	f *os.File
+	b *bufio.Writer
+}
+
+// Flushes the written data and returns a reader from the file's start.
+func (t *tempFile) reader() (*bufio.Reader, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	if err := t.b.Flush(); err != nil {
+		return nil, err
+	}
+	if _, err := t.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(t.f), nil
+}
+
+// Copies the file's contents to w.
+func (t *tempFile) copyTo(w io.Writer) error {
+	r, err := t.reader()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// Reads postings from a sorted run.
+type runReader struct {
+	r   *bufio.Reader
+	buf [12]byte
+	cur posting // Last read posting.
+}
+
+// Reads the next posting into cur. Returns false at the end of the run.
+func (r *runReader) next() (bool, error) {
+	if _, err := io.ReadFull(r.r, r.buf[:]); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	r.cur = posting{binary.LittleEndian.Uint64(r.buf[:8]),
+		binary.LittleEndian.Uint32(r.buf[8:])}
+	return true, nil
+}
+
+// WriteMappedIndex writes sketches and an index of 1/scale of their hashes,
+// in a format that can be memory-mapped by OpenMappedIndex.
+// Sketches must be sorted.
+func WriteMappedIndex(w io.Writer, sketches [][]uint64, scale uint64) error {
+	mw, err := NewMappedIndexWriter(scale, false)
+	if err != nil {
+		return err
+	}
+	defer mw.Close()
+	for _, s := range sketches {
+		if err := mw.Add(s, nil); err != nil {
+			return err
+		}
+	}
+	return mw.Finish(w, nil)
+}
+
+// Writes little-endian numbers, keeping the first error.
+type mappedWriter struct {
+	w   io.Writer
+	buf []byte
+	err error
+}
+
+func (w *mappedWriter) bytes(b []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+}
+
+func (w *mappedWriter) u64(a ...uint64) {
+	for _, x := range a {
+		w.buf = binary.LittleEndian.AppendUint64(w.buf[:0], x)
+		w.bytes(w.buf)
+	}
+}
+
+func (w *mappedWriter) u32(a ...uint32) {
+	for _, x := range a {
+		w.buf = binary.LittleEndian.AppendUint32(w.buf[:0], x)
+		w.bytes(w.buf)
+	}
+}
+
+// MappedIndex is a read-only index and sketch store, backed by a
+// memory-mapped file. It allows searching references that do not fit
+// in memory.
+type MappedIndex struct {
+	data     []byte // Mapped file contents.
+	unmap    func() error
+	mx       uint64   // Maximal indexed hash.
+	keys     []uint64 // Sorted indexed hashes.
+	offsets  []uint64 // Start of each key's postings.
+	postings []uint32 // Sketch serial numbers.
+	soffsets []uint64 // Start of each sketch in hashes.
+	hashes   []uint64 // Sketch hashes.
+	counts   []uint32 // Hash counts, nil if not written.
+	meta     []byte   // Caller-defined metadata.
+}
+
+// OpenMappedIndex maps an index file that was written by a
+// MappedIndexWriter.
+// Call Close to unmap it.
+func OpenMappedIndex(file string) (*MappedIndex, error) {
+	if !littleEndian {
+		return nil, fmt.Errorf("mapped indexes require a little-endian host")
+	}
+	data, unmap, err := mapFile(file)
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMappedIndex(data)
+	if err != nil {
+		unmap()
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	m.unmap = unmap
+	return m, nil
+}
+
+// Parses the sections of a mapped index file.
+func newMappedIndex(data []byte) (*MappedIndex, error) {
+	if len(data) < len(mappedMagic) || string(data[:len(mappedMagic)]) !=
+		mappedMagic {
+		return nil, fmt.Errorf("not a mapped index file")
+	}
+	rest := data[len(mappedMagic):]
+	take := func(n uint64, size int) ([]byte, error) {
+		if n > uint64(len(rest)/size) {
+			return nil, fmt.Errorf("file is truncated")
+		}
+		b := rest[:int(n)*size]
+		rest = rest[int(n)*size:]
+		return b, nil
+	}
+
+	b, err := take(mappedHeaderLen, 8)
+	if err != nil {
+		return nil, err
+	}
+	hdr := asUint64s(b)
+	h := mappedIndexHeader{hdr[0], hdr[1], hdr[2], hdr[3], hdr[4], hdr[5],
+		hdr[6], hdr[7]}
+	if h.version != mappedVersion {
+		return nil, fmt.Errorf("unsupported mapped index version: %d, want %d",
+			h.version, mappedVersion)
+	}
+
+	m := &MappedIndex{data: data, mx: h.mx}
+	sections := []struct {
+		n    uint64
+		size int
+		dst  any
+	}{
+		{h.nkeys, 8, &m.keys},
+		{h.nkeys + 1, 8, &m.offsets},
+		{h.nposts + h.nposts%2, 4, &m.postings},
+		{h.nsketches + 1, 8, &m.soffsets},
+		{h.nhashes, 8, &m.hashes},
+		{h.ncounts + h.ncounts%2, 4, &m.counts},
+		{h.nmeta, 1, &m.meta},
+	}
+	for _, s := range sections {
+		b, err := take(s.n, s.size)
+		if err != nil {
+			return nil, err
+		}
+		switch dst := s.dst.(type) {
+		case *[]uint64:
+			*dst = asUint64s(b)
+		case *[]uint32:
+			*dst = asUint32s(b)
+		case *[]byte:
+			*dst = b
+		}
+	}
+	m.postings = m.postings[:h.nposts]
+	m.counts = m.counts[:h.ncounts]
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("unexpected data at end of file")
+	}
+	if m.offsets[h.nkeys] != h.nposts || m.soffsets[h.nsketches] != h.nhashes ||
+		(h.ncounts != 0 && h.ncounts != h.nhashes) {
+		return nil, fmt.Errorf("bad mapped index: mismatching lengths")
+	}
+	if !nonDecreasing(m.offsets) || !nonDecreasing(m.soffsets) {
+		return nil, fmt.Errorf("bad mapped index: decreasing offsets")
+	}
+	for _, p := range m.postings {
+		if uint64(p) >= h.nsketches {
+			return nil, fmt.Errorf("bad mapped index: "+
+				"sketch number %d out of range", p)
+		}
+	}
+	return m, nil
+}
+
+// Returns whether the offsets start at 0 and never decrease.
+// Together with the last offset, this keeps all offsets in range.
+func nonDecreasing(offsets []uint64) bool {
+	if offsets[0] != 0 {
+		return false
+	}
+	for i := 1; i < len(offsets); i++ {
+		if offsets[i] < offsets[i-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// Close unmaps the index. The index and the sketches it returned must not
+// be used afterwards.
+func (m *MappedIndex) Close() error {
+	if m.unmap == nil {
+		return nil
+	}
+	err := m.unmap()
+	*m = MappedIndex{}
+	return err
+}
+
+// Len returns the number of sketches.
+func (m *MappedIndex) Len() int {
+	return len(m.soffsets) - 1
+}
+
+// Sketch returns the i'th sketch. The returned slice points to the mapped
+// file and must not be modified.
+func (m *MappedIndex) Sketch(i int) []uint64 {
+	return m.hashes[m.soffsets[i]:m.soffsets[i+1]:m.soffsets[i+1]]
+}
+
+// Counts returns the hash counts of the i'th sketch, or nil if the index
+// has no counts. The returned slice points to the mapped file and must not
+// be modified.
+func (m *MappedIndex) Counts(i int) []uint32 {
+	if m.counts == nil {
+		return nil
+	}
+	return m.counts[m.soffsets[i]:m.soffsets[i+1]:m.soffsets[i+1]]
+}
+
+// Meta returns the metadata that was given to Finish.
+// The returned slice points to the mapped file and must not be modified.
+func (m *MappedIndex) Meta() []byte {
+	return m.meta
+}
+
+// Max returns the maximal indexed hash.
+func (m *MappedIndex) Max() uint64 {
+	return m.mx
+}
+
+// Search returns serial numbers of sketches that share hashes with
+// the given sketch.
+func (m *MappedIndex) Search(s []uint64) []int {
+	var result []int
+	keys := m.keys
+	off := 0 // Offset of keys in m.keys.
+	for _, x := range s {
+		if x > m.mx {
+			break
+		}
+		// Input is sorted, so the search range only shrinks.
+		j, ok := slices.BinarySearch(keys, x)
+		off += j
+		keys = keys[j:]
+		if !ok {
+			continue
+		}
+		for _, p := range m.postings[m.offsets[off]:m.offsets[off+1]] {
+			result = append(result, int(p))
+		}
+	}
+	slices.Sort(result)
+	return slices.Compact(result)
+}
+
+// Whether the host is little-endian.
+var littleEndian = binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+
+// Reinterprets bytes as uint64s. The bytes must be 8-byte aligned.
+func asUint64s(b []byte) []uint64 {
+	if len(b) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*uint64)(unsafe.Pointer(&b[0])), len(b)/8)
+}
+
+// Reinterprets bytes as uint32s. The bytes must be 4-byte aligned.
+func asUint32s(b []byte) []uint32 {
+	if len(b) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*uint32)(unsafe.Pointer(&b[0])), len(b)/4)
+}
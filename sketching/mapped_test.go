@@ -0,0 +1,219 @@
+package sketching
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMappedIndex(t *testing.T) {
+	sketches := [][]uint64{{1, 5, 9}, {5, 10}, {}, {1, 5, 100}}
+	m := writeAndMap(t, sketches, 1)
+	if m.Len() != len(sketches) {
+		t.Fatalf("Len()=%d, want %d", m.Len(), len(sketches))
+	}
+	for i, s := range sketches {
+		if got := m.Sketch(i); !slices.Equal(got, s) {
+			t.Errorf("Sketch(%d)=%v, want %v", i, got, s)
+		}
+	}
+	tests := []struct {
+		s    []uint64
+		want []int
+	}{
+		{[]uint64{1}, []int{0, 3}},
+		{[]uint64{5}, []int{0, 1, 3}},
+		{[]uint64{9, 10}, []int{0, 1}},
+		{[]uint64{2, 3, 4}, nil},
+		{[]uint64{100, 200}, []int{3}},
+	}
+	for _, test := range tests {
+		if got := m.Search(test.s); !slices.Equal(got, test.want) {
+			t.Errorf("Search(%v)=%v, want %v", test.s, got, test.want)
+		}
+	}
+}
+
+func TestMappedIndexWriter(t *testing.T) {
+	defer func(n int) { mappedRunLen = n }(mappedRunLen)
+	mappedRunLen = 2 // Force several sorted runs.
+
+	sketches := [][]uint64{{1, 5, 9}, {5, 10}, {}, {1, 5, 100}}
+	counts := [][]uint32{{1, 2, 3}, {4, 5}, {}, {6, 7, 8}}
+	meta := []byte("hello")
+	file := filepath.Join(t.TempDir(), "a.mmi")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewMappedIndexWriter(1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for i, s := range sketches {
+		if err := w.Add(s, counts[i]); err != nil {
+			t.Fatalf("Add(%v) failed: %v", s, err)
+		}
+	}
+	if err := w.Add([]uint64{1}, nil); err == nil {
+		t.Fatalf("Add(no counts) succeeded, want error")
+	}
+	if err := w.Finish(f, meta); err != nil {
+		t.Fatalf("Finish(...) failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := OpenMappedIndex(file)
+	if err != nil {
+		t.Fatalf("OpenMappedIndex(%q) failed: %v", file, err)
+	}
+	defer m.Close()
+	if m.Len() != len(sketches) {
+		t.Fatalf("Len()=%d, want %d", m.Len(), len(sketches))
+	}
+	for i, s := range sketches {
+		if got := m.Sketch(i); !slices.Equal(got, s) {
+			t.Errorf("Sketch(%d)=%v, want %v", i, got, s)
+		}
+		if got := m.Counts(i); !slices.Equal(got, counts[i]) {
+			t.Errorf("Counts(%d)=%v, want %v", i, got, counts[i])
+		}
+	}
+	if got := m.Search([]uint64{5}); !slices.Equal(got, []int{0, 1, 3}) {
+		t.Errorf("Search([5])=%v, want [0 1 3]", got)
+	}
+	if got := m.Meta(); string(got) != string(meta) {
+		t.Errorf("Meta()=%q, want %q", got, meta)
+	}
+}
+
+func TestMappedIndex_truncated(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "a.mmi")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMappedIndex(f, [][]uint64{{1, 2}, {3}}, 1); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	stat, _ := os.Stat(file)
+	if err := os.Truncate(file, stat.Size()-8); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenMappedIndex(file); err == nil {
+		t.Fatalf("OpenMappedIndex(truncated) succeeded, want error")
+	}
+}
+
+func TestMappedIndex_corrupt(t *testing.T) {
+	// Keys 1, 2, 3; offsets at byte 96, postings at 128, soffsets at 144.
+	tests := []struct {
+		pos  int
+		size int
+		val  uint64
+	}{
+		{104, 8, 1000000000}, // Key offset.
+		{128, 4, 5},          // Posting.
+		{152, 8, 1000000000}, // Sketch offset.
+	}
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		err := WriteMappedIndex(buf, [][]uint64{{1, 2}, {3}}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := buf.Bytes()
+		if test.size == 8 {
+			binary.LittleEndian.PutUint64(b[test.pos:], test.val)
+		} else {
+			binary.LittleEndian.PutUint32(b[test.pos:], uint32(test.val))
+		}
+		file := filepath.Join(t.TempDir(), "a.mmi")
+		if err := os.WriteFile(file, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if m, err := OpenMappedIndex(file); err == nil {
+			m.Close()
+			t.Errorf("OpenMappedIndex(corrupt at %d) succeeded, want error",
+				test.pos)
+		}
+	}
+}
+
+// Compares the mapped index to the in-memory index, on a generated
+// reference with millions of hashes.
+func TestMappedIndex_large(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	defer func(n int) { mappedRunLen = n }(mappedRunLen)
+	mappedRunLen = 100000 // Force several sorted runs.
+
+	const (
+		nsketches = 20000
+		nhashes   = 200
+		scale     = 4
+	)
+	rnd := rand.New(rand.NewPCG(1, 2))
+	pool := make([]uint64, nsketches*nhashes/10) // Shared hashes.
+	for i := range pool {
+		pool[i] = rnd.Uint64()
+	}
+	sketches := make([][]uint64, nsketches)
+	idx := NewIndex(scale)
+	for i := range sketches {
+		s := make([]uint64, nhashes)
+		for j := range s {
+			s[j] = pool[rnd.IntN(len(pool))]
+		}
+		slices.Sort(s)
+		sketches[i] = slices.Compact(s)
+		idx.Add(sketches[i], i)
+	}
+
+	m := writeAndMap(t, sketches, scale)
+	for i := 0; i < nsketches; i += 97 {
+		if got := m.Sketch(i); !slices.Equal(got, sketches[i]) {
+			t.Fatalf("Sketch(%d)=%v, want %v", i, got, sketches[i])
+		}
+		want := slices.Sorted(slices.Values(idx.Search(sketches[i])))
+		if got := m.Search(sketches[i]); !slices.Equal(got, want) {
+			t.Fatalf("Search(#%d)=%v, want %v", i, got, want)
+		}
+	}
+}
+
+// Writes sketches to a mapped index file and opens it.
+func writeAndMap(t *testing.T, sketches [][]uint64, scale uint64,
+) *MappedIndex {
+	file := filepath.Join(t.TempDir(), "a.mmi")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := bufio.NewWriter(f)
+	if err := WriteMappedIndex(w, sketches, scale); err != nil {
+		t.Fatalf("WriteMappedIndex(...) failed: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := OpenMappedIndex(file)
+	if err != nil {
+		t.Fatalf("OpenMappedIndex(%q) failed: %v", file, err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
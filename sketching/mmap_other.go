@@ -0,0 +1,23 @@
+//go:build !unix
+
+package sketching
+
+import (
+	"os"
+	"unsafe"
+)
+
+// Reads a file to memory, for systems without memory mapping.
+// Returns the data and a no-op function.
+func mapFile(file string) ([]byte, func() error, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Align to 8 bytes.
+	aligned := make([]uint64, (len(data)+7)/8)
+	b := unsafe.Slice((*byte)(unsafe.Pointer(unsafe.SliceData(aligned))),
+		len(data))
+	copy(b, data)
+	return b, func() error { return nil }, nil
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package sketching
+
+import (
+	"os"
+	"syscall"
+)
+
+// Maps a file to memory, read only. Returns the data and a function that
+// unmaps it.
+func mapFile(file string) ([]byte, func() error, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if stat.Size() == 0 {
+		return nil, func() error { return nil }, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(stat.Size()),
+		syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
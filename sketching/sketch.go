@@ -11,14 +11,22 @@ import (
 	"golang.org/x/exp/maps"
 )
 
+// Hash function used for sketching, for identifying sketch compatibility.
+const (
+	HashFunc        = "murmur3-64"
+	HashSeed uint32 = 0
+)
+
 // Sketch returns a sketch with 1/scale kmer hashes/
+// Safe for concurrent use.
 func Sketch(seq []byte, k int, scale uint64) []uint64 {
 	seq = bytes.ToUpper(seq)
 	hashes := make(sets.Set[uint64], len(seq)/int(scale))
 	mx := math.MaxUint64 / scale
+	hsh := hashx.NewSeed(HashSeed) // The package-level hashx is not thread safe.
 	for sseq := range sequtil.SubsequencesWith(seq, "atcgATCG") {
 		for s := range sequtil.CanonicalSubsequences(sseq, k) {
-			h := hashx.Bytes(s)
+			h := hsh.Bytes(s)
 			if h > mx {
 				continue
 			}
@@ -27,3 +35,26 @@ func Sketch(seq []byte, k int, scale uint64) []uint64 {
 	}
 	return snm.Sorted(maps.Keys(hashes))
 }
+
+// SketchCounts returns a sketch with 1/scale kmer hashes, along with the
+// number of occurrences of each hash.
+// Safe for concurrent use.
+func SketchCounts(seq []byte, k int, scale uint64) ([]uint64, []uint32) {
+	seq = bytes.ToUpper(seq)
+	counts := make(map[uint64]uint32, len(seq)/int(scale))
+	mx := math.MaxUint64 / scale
+	hsh := hashx.NewSeed(HashSeed)
+	for sseq := range sequtil.SubsequencesWith(seq, "atcgATCG") {
+		for s := range sequtil.CanonicalSubsequences(sseq, k) {
+			h := hsh.Bytes(s)
+			if h > mx {
+				continue
+			}
+			counts[h]++
+		}
+	}
+	hashes := snm.Sorted(maps.Keys(counts))
+	return hashes, snm.SliceToSlice(hashes, func(h uint64) uint32 {
+		return counts[h]
+	})
+}
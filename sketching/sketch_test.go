@@ -0,0 +1,44 @@
+package sketching
+
+import (
+	"bytes"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestSketch_concurrent(t *testing.T) {
+	seq := bytes.Repeat([]byte("ACGTTGCATGCATGCATCGATCGATCGATGCTAGCTAGC"), 50)
+	want := Sketch(seq, 11, 1)
+	wg := &sync.WaitGroup{}
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				if got := Sketch(seq, 11, 1); !slices.Equal(got, want) {
+					t.Errorf("Sketch(...)=%v, want %v", got, want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSketchCounts(t *testing.T) {
+	seq := []byte("ACGTTGCAACGTTGCANNNACGTTGCA")
+	want := Sketch(seq, 5, 1)
+	got, counts := SketchCounts(seq, 5, 1)
+	if !slices.Equal(got, want) {
+		t.Fatalf("SketchCounts(%q)=%v, want %v", seq, got, want)
+	}
+	sum := 0
+	for _, c := range counts {
+		sum += int(c)
+	}
+	if wantSum := 12 + 4; sum != wantSum { // 12 kmers + 4 kmers.
+		t.Fatalf("SketchCounts(%q) total count=%d, want %d",
+			seq, sum, wantSum)
+	}
+}
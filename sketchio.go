@@ -0,0 +1,428 @@
+// Sketch I/O logic.
+
+package blini
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fluhus/biostuff/formats/fasta"
+	"github.com/fluhus/blini/sketching"
+	"github.com/fluhus/gostuff/aio"
+	"github.com/fluhus/gostuff/bnry"
+	"github.com/fluhus/gostuff/ppln"
+)
+
+// SketchOptions control sequence sketching.
+// At most one of the grouping options may be set.
+type SketchOptions struct {
+	K            int    // Kmer length.
+	Scale        uint64 // Use 1/Scale of the kmers.
+	Threads      int    // Number of threads to use; 0 means 1.
+	Abundance    bool   // Track kmer abundances.
+	MinAbundance int    // Discard kmers that appear less than this.
+	MinQuality   int    // Mask fastq bases with lower quality.
+
+	// Group records by the first match of this regex in their names.
+	// The first capturing group is used if present.
+	GroupRegexp *regexp.Regexp
+
+	// Group all records in a file into one genome.
+	GroupByFile bool
+
+	// Group records by a map from record name to genome name.
+	// Records are matched by their full name or by its first word.
+	GroupMap map[string]string
+}
+
+// Returns the number of threads to use.
+func (o SketchOptions) threads() int {
+	return max(o.Threads, 1)
+}
+
+// Sketches an input fasta or fastq file and iterates over the sketches.
+// Sketching is done using multiple threads, maintaining input order.
+// If grouping is enabled, records are merged into one sketch per genome.
+func sketchFile(file string, opts SketchOptions) iter.Seq2[Sketch, error] {
+	k, scale := opts.K, opts.Scale
+	seq := serialSeq(opts.threads(), SequenceFile(file, opts.MinQuality),
+		func(fa *fasta.Fasta, i int) (Sketch, error) {
+			var e Sketch
+			e.Hashes, e.Counts = sketching.SketchCounts(fa.Sequence, k, scale)
+			e.Length = len(fa.Sequence)
+			e.Name = string(fa.Name)
+			e.Records = []int{i}
+			e.Scale = scale
+			e.K = k
+			return e, nil
+		})
+	return func(yield func(Sketch, error) bool) {
+		grp, err := newGrouper(opts)
+		if err != nil {
+			yield(Sketch{}, err)
+			return
+		}
+		sketches := seq
+		if grp != nil {
+			sketches = groupSketches(seq, file, grp)
+		}
+		for e, err := range sketches {
+			if err == nil {
+				finishAbundance(&e, opts)
+			}
+			if !yield(e, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Removes hashes with counts lower than the minimal abundance,
+// and removes the counts if abundances are not tracked.
+func finishAbundance(e *Sketch, opts SketchOptions) {
+	if opts.MinAbundance > 1 {
+		j := 0
+		for i, c := range e.Counts {
+			if int(c) < opts.MinAbundance {
+				continue
+			}
+			e.Hashes[j] = e.Hashes[i]
+			e.Counts[j] = c
+			j++
+		}
+		e.Hashes = e.Hashes[:j]
+		e.Counts = e.Counts[:j]
+	}
+	if !opts.Abundance {
+		e.Counts = nil
+	}
+}
+
+// Error for stopping a pipeline when its consumer stops iterating.
+var errStopped = errors.New("stopped")
+
+// Applies transform to the input elements using n goroutines,
+// and iterates over the results in input order.
+// Transform receives an element and its 0-based serial number.
+func serialSeq[T1, T2 any](n int, input iter.Seq2[T1, error],
+	transform func(T1, int) (T2, error)) iter.Seq2[T2, error] {
+	return func(yield func(T2, error) bool) {
+		ch := make(chan T2, n)
+		done := make(chan struct{})
+		defer close(done)
+		errc := make(chan error, 1)
+		go func() {
+			// Some outputs may be called after Serial returns with an error,
+			// so ch is never closed.
+			errc <- ppln.Serial(n, input,
+				func(a T1, i, g int) (T2, error) {
+					return transform(a, i)
+				}, func(a T2) error {
+					select {
+					case ch <- a:
+						return nil
+					case <-done:
+						return errStopped
+					}
+				})
+		}()
+
+		for {
+			select {
+			case a := <-ch:
+				if !yield(a, nil) {
+					return
+				}
+			case err := <-errc:
+				for len(ch) > 0 { // Yield what remains in the buffer.
+					if !yield(<-ch, nil) {
+						return
+					}
+				}
+				if err != nil {
+					var zero T2
+					yield(zero, err)
+				}
+				return
+			}
+		}
+	}
+}
+
+const (
+	sketchMagic   = "BLINI\x00SK" // Beginning of every sketch file segment.
+	sketchVersion = 1             // Current sketch file format version.
+)
+
+// SketchFileHeader is the header of a sketch file segment.
+// A sketch file is a concatenation of one or more segments,
+// each made of a header followed by its records.
+type SketchFileHeader struct {
+	Version uint64 // Format version.
+	K       int    // Kmer length.
+	Scale   uint64 // Kmer selection scale.
+	Hash    string // Hash function name.
+	Seed    uint32 // Hash function seed.
+	Creator string // Blini version that created the segment.
+	Created int64  // Creation time, in unix seconds.
+
+	// Number of records in the segment.
+	// If negative, the number is not known in advance;
+	// each record is then preceded by a true flag, and the segment ends
+	// with a false flag.
+	N int
+
+	Counts bool // Whether records include hash counts.
+}
+
+// Returns a header for a new segment.
+func newSketchHeader(k int, scale uint64, n int, counts bool,
+) SketchFileHeader {
+	return SketchFileHeader{
+		Version: sketchVersion,
+		K:       k,
+		Scale:   scale,
+		Hash:    sketching.HashFunc,
+		Seed:    sketching.HashSeed,
+		Creator: Version,
+		Created: time.Now().Unix(),
+		N:       n,
+		Counts:  counts,
+	}
+}
+
+// Writes the magic and the given segment header.
+func writeSketchHeader(w io.Writer, h SketchFileHeader) error {
+	if _, err := io.WriteString(w, sketchMagic); err != nil {
+		return err
+	}
+	return bnry.Write(w, h.Version, h.K, h.Scale, h.Hash, h.Seed,
+		h.Creator, h.Created, h.N, h.Counts)
+}
+
+// Writes a single record of a segment with the given header.
+func writeSketchRecord(w io.Writer, h SketchFileHeader, s Sketch) error {
+	if err := bnry.Write(w, s.Hashes, s.Length, s.Name); err != nil {
+		return err
+	}
+	if h.Counts {
+		return bnry.Write(w, s.Counts)
+	}
+	return nil
+}
+
+// WriteSketches writes the given sketches as a single file segment.
+func WriteSketches(w io.Writer, sk *Sketches) error {
+	h := newSketchHeader(sk.K, sk.Scale, sk.Len(), sk.Counts != nil)
+	if err := writeSketchHeader(w, h); err != nil {
+		return err
+	}
+	for i := range sk.Len() {
+		if err := writeSketchRecord(w, h, sk.At(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SketchWriter writes sketches one at a time as a single file segment,
+// without knowing their number in advance.
+type SketchWriter struct {
+	w io.Writer
+	h SketchFileHeader
+}
+
+// NewSketchWriter writes the header of a segment of sketches with the
+// given kmer length, scale and abundance tracking, and returns a writer
+// of its records. Call Close to end the segment.
+func NewSketchWriter(w io.Writer, k int, scale uint64, counts bool,
+) (*SketchWriter, error) {
+	h := newSketchHeader(k, scale, -1, counts)
+	if err := writeSketchHeader(w, h); err != nil {
+		return nil, err
+	}
+	return &SketchWriter{w, h}, nil
+}
+
+// Write writes a sketch. Returns an error if its scale, kmer length or
+// abundance tracking differ from those of the segment.
+func (w *SketchWriter) Write(s Sketch) error {
+	if s.Scale != w.h.Scale {
+		return fmt.Errorf("mismatching scales: %d, %d", w.h.Scale, s.Scale)
+	}
+	if s.K != w.h.K {
+		return fmt.Errorf("mismatching kmer lengths: %d, %d", w.h.K, s.K)
+	}
+	if (s.Counts != nil) != w.h.Counts {
+		return fmt.Errorf("mismatching abundance tracking")
+	}
+	if err := bnry.Write(w.w, true); err != nil {
+		return err
+	}
+	return writeSketchRecord(w.w, w.h, s)
+}
+
+// Close ends the segment. It does not close the underlying writer.
+func (w *SketchWriter) Close() error {
+	return bnry.Write(w.w, false)
+}
+
+// Reads and validates a segment header. Returns io.EOF if there are
+// no more segments.
+func readSketchHeader(r *aio.Reader) (SketchFileHeader, error) {
+	var h SketchFileHeader
+	magic := make([]byte, len(sketchMagic))
+	if n, err := io.ReadFull(r, magic); err != nil {
+		if n == 0 && err == io.EOF {
+			return h, io.EOF
+		}
+		if err == io.ErrUnexpectedEOF {
+			return h, fmt.Errorf("not a blini sketch file or truncated")
+		}
+		return h, err
+	}
+	if string(magic) != sketchMagic {
+		return h, fmt.Errorf("not a blini sketch file " +
+			"(or created by an older version of blini)")
+	}
+	err := bnry.Read(r, &h.Version, &h.K, &h.Scale, &h.Hash, &h.Seed,
+		&h.Creator, &h.Created, &h.N, &h.Counts)
+	if err != nil {
+		return h, fmt.Errorf("bad sketch file header: %w", unexpected(err))
+	}
+	if h.Version != sketchVersion {
+		return h, fmt.Errorf("unsupported sketch file version: %d, want %d",
+			h.Version, sketchVersion)
+	}
+	if h.Hash != sketching.HashFunc || h.Seed != sketching.HashSeed {
+		return h, fmt.Errorf("unsupported hash function: %s (seed %d), "+
+			"want %s (seed %d)", h.Hash, h.Seed,
+			sketching.HashFunc, sketching.HashSeed)
+	}
+	return h, nil
+}
+
+// ReadSketches iterates over sketches in a sketch file.
+func ReadSketches(file string) iter.Seq2[Sketch, error] {
+	return ReadSketchesFunc(file, nil)
+}
+
+// ReadSketchesFunc iterates over sketches in a sketch file,
+// calling onHeader (if not nil) on each segment header before its records.
+func ReadSketchesFunc(file string, onHeader func(SketchFileHeader),
+) iter.Seq2[Sketch, error] {
+	return func(yield func(Sketch, error) bool) {
+		f, err := aio.Open(file)
+		if err != nil {
+			yield(Sketch{}, err)
+			return
+		}
+		defer f.Close()
+
+		for iseg := 0; ; iseg++ {
+			h, err := readSketchHeader(f)
+			if err != nil {
+				if err == io.EOF {
+					return
+				}
+				yield(Sketch{}, fmt.Errorf("%s: segment #%d: %w",
+					file, iseg+1, err))
+				return
+			}
+			if onHeader != nil {
+				onHeader(h)
+			}
+			for i := 0; h.N < 0 || i < h.N; i++ {
+				var err error
+				if h.N < 0 {
+					more := false
+					if err = bnry.Read(f, &more); err == nil && !more {
+						break
+					}
+				}
+				e := Sketch{Scale: h.Scale, K: h.K}
+				if err == nil {
+					err = bnry.Read(f, &e.Hashes, &e.Length, &e.Name)
+				}
+				if err == nil && h.Counts {
+					err = bnry.Read(f, &e.Counts)
+					if e.Counts == nil { // Empty counts are read as nil.
+						e.Counts = []uint32{}
+					}
+				}
+				if err != nil {
+					rec := fmt.Sprint(i + 1)
+					if h.N >= 0 {
+						rec += fmt.Sprint("/", h.N)
+					}
+					yield(Sketch{}, fmt.Errorf(
+						"%s: segment #%d: record %s: %w",
+						file, iseg+1, rec, unexpected(err)))
+					return
+				}
+				if !yield(e, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Converts EOF errors to a truncation error, for reads that should succeed.
+func unexpected(err error) error {
+	if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("file is truncated")
+	}
+	return err
+}
+
+// CollectSketches collects sketches from an iterator,
+// validating that their scales, kmer lengths and abundance tracking are
+// the same.
+func CollectSketches(seq iter.Seq2[Sketch, error]) (*Sketches, error) {
+	sk := &Sketches{}
+	for s, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		if err := sk.Add(s); err != nil {
+			return nil, err
+		}
+	}
+	return sk, nil
+}
+
+// LoadSketches reads or sketches the given input, according to its suffix.
+// Sketch files (with SketchFileSuffix) are read as is, ignoring opts.
+// Other inputs are sketched using SketchInput.
+func LoadSketches(ctx context.Context, input string, opts SketchOptions,
+) (*Sketches, error) {
+	var seq iter.Seq2[Sketch, error]
+	if strings.HasSuffix(input, SketchFileSuffix) {
+		seq = ReadSketches(input)
+	} else {
+		seq = SketchInput(input, opts)
+	}
+	return CollectSketches(withContext(ctx, seq))
+}
+
+// Stops an iteration with the context's error when it is done.
+func withContext[T any](ctx context.Context, seq iter.Seq2[T, error],
+) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		for x, err := range seq {
+			if err == nil {
+				err = ctx.Err()
+			}
+			if !yield(x, err) || err != nil {
+				return
+			}
+		}
+	}
+}
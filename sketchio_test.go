@@ -0,0 +1,264 @@
+package blini
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/fluhus/gostuff/ppln"
+)
+
+func TestSerialSeq(t *testing.T) {
+	want := []int{0, 2, 4, 6, 8, 10, 12, 14, 16, 18}
+	for _, n := range []int{1, 2, 4} {
+		var got []int
+		for x, err := range serialSeq(n, ppln.RangeInput(0, 10),
+			func(i, _ int) (int, error) { return i * 2, nil }) {
+			if err != nil {
+				t.Fatalf("serialSeq(%d) failed: %v", n, err)
+			}
+			got = append(got, x)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("serialSeq(%d)=%v, want %v", n, got, want)
+		}
+	}
+}
+
+func TestSerialSeq_break(t *testing.T) {
+	for _, n := range []int{1, 4} {
+		var got []int
+		for x, err := range serialSeq(n, ppln.RangeInput(0, 1000),
+			func(i, _ int) (int, error) { return i, nil }) {
+			if err != nil {
+				t.Fatalf("serialSeq(%d) failed: %v", n, err)
+			}
+			if x == 3 {
+				break
+			}
+			got = append(got, x)
+		}
+		if want := []int{0, 1, 2}; !slices.Equal(got, want) {
+			t.Errorf("serialSeq(%d)=%v, want %v", n, got, want)
+		}
+	}
+}
+
+func TestSerialSeq_error(t *testing.T) {
+	input := func(yield func(int, error) bool) {
+		if !yield(1, nil) {
+			return
+		}
+		yield(0, fmt.Errorf("oops"))
+	}
+	var gotErr error
+	for _, err := range serialSeq(2, input, func(i, _ int) (int, error) { return i, nil }) {
+		if err != nil {
+			gotErr = err
+		}
+	}
+	if gotErr == nil {
+		t.Fatalf("serialSeq(...) succeeded, want error")
+	}
+}
+
+func TestCollectSketches(t *testing.T) {
+	tests := []struct {
+		a, b Sketch
+	}{
+		{Sketch{Scale: 100, K: 21}, Sketch{Scale: 50, K: 21}},
+		{Sketch{Scale: 100, K: 21}, Sketch{Scale: 100, K: 15}},
+		{Sketch{Scale: 100, K: 21, Counts: []uint32{}},
+			Sketch{Scale: 100, K: 21}},
+	}
+	for _, test := range tests {
+		input := ppln.SliceInput([]Sketch{test.a, test.b})
+		if _, err := CollectSketches(input); err == nil {
+			t.Errorf("CollectSketches(%v,%v) succeeded, want error",
+				test.a, test.b)
+		}
+	}
+	input := ppln.SliceInput([]Sketch{
+		{Scale: 100, K: 15}, {Scale: 100, K: 15}})
+	sk, err := CollectSketches(input)
+	if err != nil {
+		t.Fatalf("CollectSketches(...) failed: %v", err)
+	}
+	if sk.Scale != 100 || sk.K != 15 {
+		t.Errorf("CollectSketches(...)=(%d,%d), want (100,15)",
+			sk.Scale, sk.K)
+	}
+}
+
+func TestSketchFile(t *testing.T) {
+	sk1 := &Sketches{
+		Hashes:  [][]uint64{{1, 2, 3}, {4, 5}},
+		Lengths: []int{100, 200},
+		Names:   []string{"a", "b"},
+		Scale:   10,
+		K:       15,
+	}
+	sk2 := &Sketches{
+		Hashes:  [][]uint64{{6}},
+		Lengths: []int{300},
+		Names:   []string{"c"},
+		Scale:   10,
+		K:       15,
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteSketches(buf, sk1); err != nil {
+		t.Fatalf("WriteSketches(...) failed: %v", err)
+	}
+	if err := WriteSketches(buf, sk2); err != nil {
+		t.Fatalf("WriteSketches(...) failed: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "a.blini")
+	if err := os.WriteFile(file, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := CollectSketches(ReadSketches(file))
+	if err != nil {
+		t.Fatalf("ReadSketches(...) failed: %v", err)
+	}
+	want := &Sketches{
+		Hashes:  [][]uint64{{1, 2, 3}, {4, 5}, {6}},
+		Lengths: []int{100, 200, 300},
+		Names:   []string{"a", "b", "c"},
+		Records: [][]int{nil, nil, nil},
+		Scale:   10,
+		K:       15,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ReadSketches(...)=%v, want %v", got, want)
+	}
+
+	// Truncated file.
+	err = os.WriteFile(file, buf.Bytes()[:buf.Len()-3], 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CollectSketches(ReadSketches(file)); err == nil {
+		t.Fatalf("ReadSketches(truncated) succeeded, want error")
+	}
+}
+
+func TestSketchFile_counts(t *testing.T) {
+	want := &Sketches{
+		Hashes:  [][]uint64{{1, 2, 3}, {4, 5}, nil},
+		Lengths: []int{100, 200, 10},
+		Names:   []string{"a", "b", "c"},
+		Records: [][]int{nil, nil, nil},
+		Counts:  [][]uint32{{1, 1, 2}, {3, 1}, {}},
+		Scale:   10,
+		K:       15,
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteSketches(buf, want); err != nil {
+		t.Fatalf("WriteSketches(...) failed: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "a.blini")
+	if err := os.WriteFile(file, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := CollectSketches(ReadSketches(file))
+	if err != nil {
+		t.Fatalf("ReadSketches(...) failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ReadSketches(...)=%v, want %v", got, want)
+	}
+}
+
+func TestSketchWriter(t *testing.T) {
+	want := &Sketches{
+		Hashes:  [][]uint64{{1, 2, 3}, {4, 5}, {6}},
+		Lengths: []int{100, 200, 300},
+		Names:   []string{"a", "b", "c"},
+		Records: [][]int{nil, nil, nil},
+		Counts:  [][]uint32{{1, 1, 2}, {3, 1}, {2}},
+		Scale:   10,
+		K:       15,
+	}
+	buf := &bytes.Buffer{}
+	w, err := NewSketchWriter(buf, 15, 10, true)
+	if err != nil {
+		t.Fatalf("NewSketchWriter(...) failed: %v", err)
+	}
+	for i := range 2 {
+		if err := w.Write(want.At(i)); err != nil {
+			t.Fatalf("Write(%v) failed: %v", want.At(i), err)
+		}
+	}
+	if err := w.Write(Sketch{Scale: 10, K: 15}); err == nil {
+		t.Fatalf("Write(no counts) succeeded, want error")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	last := &Sketches{
+		Hashes:  want.Hashes[2:],
+		Lengths: want.Lengths[2:],
+		Names:   want.Names[2:],
+		Counts:  want.Counts[2:],
+		Scale:   10,
+		K:       15,
+	}
+	if err := WriteSketches(buf, last); err != nil {
+		t.Fatalf("WriteSketches(...) failed: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "a.blini")
+	if err := os.WriteFile(file, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := CollectSketches(ReadSketches(file))
+	if err != nil {
+		t.Fatalf("ReadSketches(...) failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ReadSketches(...)=%v, want %v", got, want)
+	}
+
+	// Missing end of segment.
+	buf.Reset()
+	w, err = NewSketchWriter(buf, 15, 10, false)
+	if err != nil {
+		t.Fatalf("NewSketchWriter(...) failed: %v", err)
+	}
+	err = w.Write(Sketch{Hashes: []uint64{1}, Scale: 10, K: 15})
+	if err != nil {
+		t.Fatalf("Write(...) failed: %v", err)
+	}
+	if err := os.WriteFile(file, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CollectSketches(ReadSketches(file)); err == nil {
+		t.Fatalf("ReadSketches(unended) succeeded, want error")
+	}
+}
+
+func TestSketchFile_groupTwice(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "a.fa")
+	err := os.WriteFile(file, []byte(">a1\nACGTACGTAC\n>a2\nTTGCATTGCA\n"),
+		0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Grouping twice would rename "g" to "h".
+	opts := SketchOptions{K: 5, Scale: 1,
+		GroupMap: map[string]string{"a1": "g", "a2": "g", "g": "h"}}
+	seq := sketchFile(file, opts)
+	for i := range 2 {
+		got, err := CollectSketches(seq)
+		if err != nil {
+			t.Fatalf("sketchFile(...) #%d failed: %v", i, err)
+		}
+		if !slices.Equal(got.Names, []string{"g"}) {
+			t.Fatalf("sketchFile(...) #%d names=%v, want [g]", i, got.Names)
+		}
+	}
+}